@@ -0,0 +1,79 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+/*
+ * This file contains the syscall transition bitmap, a coverage measure
+ * in the manner of AFL's edge map. Every pair of consecutive syscall
+ * traps of a task is hashed to a counter in the bitmap, and counts are
+ * bucketed so that loops running a few more times than before are not
+ * new behaviour.
+ */
+
+/*
+ * Number of counters in a bitmap.
+ */
+const bitmapSize = 1 << 16
+
+/*
+ * Hit counts of the syscall transitions of one run, saturating at 255,
+ * or of the edges an instrumented program counted, which wrap.
+ */
+type transitionBitmap [bitmapSize]uint8
+
+/*
+ * Builds the transition bitmap of a trace. Transitions are taken per
+ * task, so the interleaving of threads does not change the bitmap.
+ */
+func syscallBitmap(t execTrace) *transitionBitmap {
+	var b transitionBitmap
+	// Each task's previous location, shifted as in AFL so that A->B
+	// and B->A hit different counters.
+	prev := map[int]uint32{}
+	for _, r := range t.trace {
+		cur := trapLocation(r)
+		i := (cur ^ prev[r.task]) % bitmapSize
+		if b[i] < 255 {
+			b[i]++
+		}
+		prev[r.task] = cur >> 1
+	}
+	return &b
+}
+
+/*
+ * Hashes a syscall trap, regardless of the task making it, to a
+ * location in the bitmap.
+ */
+func trapLocation(r regSet) uint32 {
+	r.task = 0
+	var buf [16]byte
+	encodeRegs(r, &buf)
+	h := fnv.New32a()
+	h.Write(buf[:])
+	return h.Sum32() % bitmapSize
+}
+
+/*
+ * Buckets a hit count into one of eight bits as AFL does: 1, 2, 3,
+ * 4-7, 8-15, 16-31, 32-127 and 128 or more hits.
+ */
+func countBucket(count uint8) uint8 {
+	switch {
+	case count == 0:
+		return 0
+	case count <= 3:
+		return 1 << (count - 1)
+	case count <= 7:
+		return 1 << 3
+	case count <= 15:
+		return 1 << 4
+	case count <= 31:
+		return 1 << 5
+	case count <= 127:
+		return 1 << 6
+	}
+	return 1 << 7
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"golang.org/x/arch/x86/x86asm"
+	syscall "golang.org/x/sys/unix"
+	"os"
+	"sync"
+)
+
+/*
+ * This file contains basic block coverage for binaries built without
+ * instrumentation. Block entries are found by disassembling the
+ * program's .text section, and every block not yet covered gets a
+ * one-shot int3 breakpoint, which is removed once it is hit.
+ * Only the program's own code is covered, not its libraries, and .text
+ * is assumed to hold only code, as compilers emit it.
+ */
+
+/*
+ * Size of the chunks of .text breakpoints are written to programs in.
+ */
+const blockChunkSize = 4096
+
+/*
+ * Instructions which end a basic block by branching. The instruction
+ * after one starts a block, unless the branch never falls through.
+ */
+var branchOps = map[x86asm.Op]bool{
+	x86asm.JA: true, x86asm.JAE: true, x86asm.JB: true, x86asm.JBE: true,
+	x86asm.JCXZ: true, x86asm.JE: true, x86asm.JECXZ: true, x86asm.JG: true,
+	x86asm.JGE: true, x86asm.JL: true, x86asm.JLE: true, x86asm.JNE: true,
+	x86asm.JNO: true, x86asm.JNP: true, x86asm.JNS: true, x86asm.JO: true,
+	x86asm.JP: true, x86asm.JRCXZ: true, x86asm.JS: true, x86asm.LOOP: true,
+	x86asm.LOOPE: true, x86asm.LOOPNE: true, x86asm.CALL: true,
+	x86asm.JMP: true, x86asm.RET: true, x86asm.LJMP: true, x86asm.LRET: true,
+}
+
+/*
+ * Basic blocks of a program and those covered by all harnesses, safe
+ * for concurrent use.
+ * file: the program's ELF file, kept open to relocate addresses.
+ * path: path of the program.
+ * textAddr: link time address of .text.
+ * text: original contents of .text.
+ * blocks: link time addresses of the block entries.
+ * image: .text with an int3 at every block not yet covered.
+ * pending: number of blocks not yet covered in each chunk of image.
+ * covered: blocks covered by any run.
+ */
+type blockCoverage struct {
+	mu       sync.Mutex
+	file     *elf.File
+	path     string
+	textAddr uint64
+	text     []byte
+	blocks   map[uint64]bool
+	image    []byte
+	pending  map[int]int
+	covered  map[uint64]bool
+}
+
+/*
+ * Finds the basic blocks of the program at path.
+ */
+func loadBlockCoverage(path string) (*blockCoverage, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Machine != elf.EM_X86_64 {
+		f.Close()
+		return nil, fmt.Errorf("%s is not an x86-64 program", path)
+	}
+	sec := f.Section(".text")
+	if sec == nil {
+		f.Close()
+		return nil, fmt.Errorf("%s has no .text section", path)
+	}
+	text, err := sec.Data()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := &blockCoverage{file: f, path: path, textAddr: sec.Addr, text: text,
+		blocks: map[uint64]bool{}, pending: map[int]int{}, covered: map[uint64]bool{}}
+	c.findBlocks()
+	if len(c.blocks) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("no basic blocks found in %s", path)
+	}
+	c.image = append([]byte{}, text...)
+	for b := range c.blocks {
+		off := b - c.textAddr
+		c.image[off] = 0xcc
+		c.pending[int(off/blockChunkSize)]++
+	}
+	return c, nil
+}
+
+/*
+ * Adds the entries of functions, the targets of direct branches and the
+ * instructions after branches which fall through to the blocks.
+ */
+func (c *blockCoverage) findBlocks() {
+	add := func(addr uint64) {
+		// Blocks starting with an int3 of their own would trap forever.
+		if addr >= c.textAddr && addr < c.textAddr+uint64(len(c.text)) &&
+			c.text[addr-c.textAddr] != 0xcc {
+			c.blocks[addr] = true
+		}
+	}
+
+	syms, _ := c.file.Symbols()
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC {
+			add(sym.Value)
+		}
+	}
+
+	for off := 0; off < len(c.text); {
+		inst, err := x86asm.Decode(c.text[off:], 64)
+		if err != nil || inst.Len == 0 {
+			off++
+			continue
+		}
+		next := c.textAddr + uint64(off+inst.Len)
+		off += inst.Len
+		if !branchOps[inst.Op] {
+			continue
+		}
+		if rel, ok := inst.Args[0].(x86asm.Rel); ok {
+			add(next + uint64(int64(rel)))
+		}
+		switch inst.Op {
+		case x86asm.JMP, x86asm.LJMP, x86asm.RET, x86asm.LRET:
+		default:
+			add(next)
+		}
+	}
+}
+
+/*
+ * Breakpoints planted in one program for a run.
+ * c: blocks the breakpoints are for.
+ * bias: difference between the run time and link time addresses of
+ *       the program's code.
+ */
+type blockTraps struct {
+	c    *blockCoverage
+	bias uint64
+}
+
+/*
+ * Plants breakpoints at the blocks not yet covered in the stopped
+ * program pid. Only chunks of .text holding such blocks are written.
+ */
+func (c *blockCoverage) plant(pid int) (*blockTraps, error) {
+	loaded, err := relocate(c.file, c.path, c.textAddr, pid)
+	if err != nil {
+		return nil, err
+	}
+	t := &blockTraps{c: c, bias: uint64(loaded) - c.textAddr}
+
+	c.mu.Lock()
+	chunks := make(map[int][]byte, len(c.pending))
+	for i := range c.pending {
+		end := (i + 1) * blockChunkSize
+		if end > len(c.image) {
+			end = len(c.image)
+		}
+		chunks[i] = append([]byte{}, c.image[i*blockChunkSize:end]...)
+	}
+	c.mu.Unlock()
+	if len(chunks) == 0 {
+		return t, nil
+	}
+
+	mem, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", pid), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+	for i, chunk := range chunks {
+		_, err = mem.WriteAt(chunk, int64(uint64(loaded)+uint64(i*blockChunkSize)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to plant breakpoints: %s", err.Error())
+		}
+	}
+	return t, nil
+}
+
+/*
+ * Handles a SIGTRAP stop of task tid. If it was raised by a planted
+ * breakpoint, the original code is put back and the task rewound to run
+ * it. Breakpoints of blocks covered since they were planted are
+ * handled the same way.
+ * Returns the link time address of the block and whether the stop was
+ * a planted breakpoint.
+ */
+func (t *blockTraps) hit(tid int) (uint64, bool, error) {
+	var regs syscall.PtraceRegs
+	err := syscall.PtraceGetRegs(tid, &regs)
+	if err != nil {
+		return 0, false, err
+	}
+	// The breakpoint leaves the instruction pointer just past it.
+	block := regs.Rip - 1 - t.bias
+	if !t.c.blocks[block] {
+		return 0, false, nil
+	}
+	// Blocks starting with an int3 of the program's own have no
+	// breakpoint planted over it.
+	orig := t.c.text[block-t.c.textAddr]
+	if orig == 0xcc {
+		return 0, false, nil
+	}
+	// A SIGTRAP sent to the program, e.g. with kill or raise, may stop
+	// it just past a block entry too, but only int3 traps come from
+	// the kernel.
+	code, _, err := getSigInfo(tid)
+	if err != nil {
+		return 0, false, err
+	}
+	if code != siKernel {
+		return 0, false, nil
+	}
+	_, err = syscall.PtracePokeData(tid, uintptr(regs.Rip-1), []byte{orig})
+	if err != nil {
+		return 0, false, err
+	}
+	regs.Rip--
+	err = syscall.PtraceSetRegs(tid, &regs)
+	if err != nil {
+		return 0, false, err
+	}
+	return block, true, nil
+}
+
+/*
+ * Records the blocks hit by a run as covered, so no breakpoints are
+ * planted for them again.
+ * Returns whether any of them had not been covered before.
+ */
+func (c *blockCoverage) add(hits []uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := false
+	for _, b := range hits {
+		if c.covered[b] {
+			continue
+		}
+		c.covered[b] = true
+		off := b - c.textAddr
+		c.image[off] = c.text[off]
+		chunk := int(off / blockChunkSize)
+		c.pending[chunk]--
+		if c.pending[chunk] == 0 {
+			delete(c.pending, chunk)
+		}
+		found = true
+	}
+	return found
+}
+
+/*
+ * Describes the blocks covered, e.g. "120/800 blocks".
+ */
+func (c *blockCoverage) summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("%d/%d blocks", len(c.covered), len(c.blocks))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	syscall "golang.org/x/sys/unix"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+/*
+ * This file keeps track of the programs and temporary files the
+ * fuzzer has created, so they are removed however the fuzzer exits.
+ */
+
+/*
+ * Running programs and temporary files owned by the fuzzer.
+ * programs: tasks of running programs and fork servers, keyed by the
+ *           pid of the program.
+ * paths: temporary files and directories.
+ */
+var owned = struct {
+	mu       sync.Mutex
+	programs map[int]*programTasks
+	paths    map[string]bool
+}{programs: map[int]*programTasks{}, paths: map[string]bool{}}
+
+/*
+ * Tasks of a traced program. Tasks may leave the program's process
+ * group with setsid or setpgid, so every task the program creates is
+ * recorded to be killed with it.
+ * mu: guards tids.
+ * tids: tasks of the program which have not been reaped.
+ */
+type programTasks struct {
+	mu   sync.Mutex
+	tids map[int]bool
+}
+
+/*
+ * Records a program started as pid.
+ */
+func trackProgram(pid int) {
+	owned.mu.Lock()
+	owned.programs[pid] = &programTasks{tids: map[int]bool{pid: true}}
+	owned.mu.Unlock()
+}
+
+/*
+ * Returns the tasks of the program started as pid, or a set holding
+ * only pid if the program is not tracked.
+ */
+func trackedTasks(pid int) *programTasks {
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	if t, ok := owned.programs[pid]; ok {
+		return t
+	}
+	return &programTasks{tids: map[int]bool{pid: true}}
+}
+
+/*
+ * Forgets a program which has been killed.
+ */
+func untrackProgram(pid int) {
+	owned.mu.Lock()
+	delete(owned.programs, pid)
+	owned.mu.Unlock()
+}
+
+/*
+ * Records a task created by the program.
+ */
+func (t *programTasks) add(tid int) {
+	t.mu.Lock()
+	t.tids[tid] = true
+	t.mu.Unlock()
+}
+
+/*
+ * Forgets a task which has been reaped.
+ */
+func (t *programTasks) remove(tid int) {
+	t.mu.Lock()
+	delete(t.tids, tid)
+	t.mu.Unlock()
+}
+
+/*
+ * Returns whether tid is a task of the program.
+ */
+func (t *programTasks) has(tid int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tids[tid]
+}
+
+/*
+ * Returns the tasks of the program.
+ */
+func (t *programTasks) list() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var tids []int
+	for tid := range t.tids {
+		tids = append(tids, tid)
+	}
+	return tids
+}
+
+/*
+ * Sends SIGKILL to every task of the program. Tasks are not reaped
+ * until their tracer waits for them, so their tids can not be reused
+ * by other processes in the meantime.
+ */
+func (t *programTasks) kill() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tid := range t.tids {
+		syscall.Kill(tid, syscall.SIGKILL)
+	}
+}
+
+/*
+ * Records a temporary file or directory to remove on exit.
+ */
+func trackTempPath(path string) {
+	owned.mu.Lock()
+	owned.paths[path] = true
+	owned.mu.Unlock()
+}
+
+/*
+ * Removes a temporary file or empty directory and forgets it.
+ */
+func removeTempPath(path string) {
+	owned.mu.Lock()
+	delete(owned.paths, path)
+	owned.mu.Unlock()
+	os.Remove(path)
+}
+
+/*
+ * Kills every running program and removes every temporary path.
+ * Programs are not reaped, as their tracer may be busy, but are
+ * also killed by PTRACE_O_EXITKILL once the fuzzer exits.
+ */
+func cleanupAll() {
+	owned.mu.Lock()
+	defer owned.mu.Unlock()
+	for _, tasks := range owned.programs {
+		tasks.kill()
+	}
+	for path := range owned.paths {
+		os.Remove(path)
+	}
+}
+
+/*
+ * Cleans up and exits with code.
+ */
+func exitFuzzer(code int) {
+	cleanupAll()
+	os.Exit(code)
+}
+
+/*
+ * Cleans up and exits when the fuzzer is interrupted or terminated.
+ */
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, stopping\n", sig)
+		exitFuzzer(128 + int(sig.(syscall.Signal)))
+	}()
+}
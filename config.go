@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+ * Placeholder in the target arguments which is replaced by the path
+ * of a file holding the current input.
+ */
+const inputPlaceholder = "@@"
+
+/*
+ * Options controlling how a harness runs the target program.
+ * cmd: path of the program to fuzz.
+ * args: arguments passed to the program, which may contain inputPlaceholder.
+ * env: environment of the program in "KEY=value" form.
+ * dir: working directory of the program, empty for the fuzzer's own.
+ * rlimits: resource limits applied to the program.
+ * timeout: wall clock limit for a single run, zero disables it.
+ * maxSyscalls: syscall limit for a single run, zero disables it.
+ * stopOnCrash: exit the fuzzer after the first crash is saved.
+ * stackDepth: number of stack frames used to bucket crashes.
+ * outputLimit: number of bytes of stdout and stderr kept from each run.
+ * outputOracles: expressions which flag a run when its output matches.
+ * exitOracles: exit codes which flag a run.
+ * forkServer: run inputs in copies of a fork server, see forkserver.go.
+ * forkServerEntry: function the fork server is stopped at.
+ * sandbox: filesystem view of the sandbox, empty to run unsandboxed,
+ *          see sandbox.go.
+ * sandboxDir: empty directory the sandbox mounts its tmpfs on.
+ * netProto: protocol inputs are sent to a server over, empty to send
+ *           them on stdin, see network.go.
+ * netPort: loopback port the server listens on.
+ * netReplyTimeout: time without a reply from the server after which
+ *                  the run ends.
+ * snapshotPoint: function or address inputs are run from, empty to run
+ *                the program from the start, see restore.go.
+ * snapshotBuffer: function or address inputs are written to in snapshot
+ *                 mode, empty to pass them on stdin.
+ * snapshotBufferSize: size of the buffer, zero to take the size of the
+ *                     symbol.
+ */
+type harnessConfig struct {
+	cmd         string
+	args        []string
+	env         []string
+	dir         string
+	rlimits     []rlimit
+	timeout     time.Duration
+	maxSyscalls int
+	stopOnCrash bool
+	stackDepth  int
+
+	outputLimit   int
+	outputOracles []*regexp.Regexp
+	exitOracles   []int
+
+	forkServer      bool
+	forkServerEntry string
+
+	sandbox    string
+	sandboxDir string
+
+	netProto        string
+	netPort         int
+	netReplyTimeout time.Duration
+
+	snapshotPoint      string
+	snapshotBuffer     string
+	snapshotBufferSize int
+}
+
+/*
+ * Checks whether inputs are passed to the program as a file
+ * rather than on stdin.
+ */
+func (c *harnessConfig) usesInputFile() bool {
+	for _, arg := range c.args {
+		if strings.Contains(arg, inputPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Builds the program arguments for a run, with every inputPlaceholder
+ * replaced by inputPath.
+ */
+func (c *harnessConfig) targetArgs(inputPath string) []string {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		args[i] = strings.Replace(arg, inputPlaceholder, inputPath, -1)
+	}
+	return args
+}
+
+/*
+ * Finds the program to fuzz. Names without a path separator are looked
+ * up in the current directory first, then on PATH.
+ * Returns an absolute path so the program is found from any working
+ * directory.
+ */
+func resolveBinary(name string) (string, error) {
+	if !strings.Contains(name, "/") {
+		_, err := os.Stat(name)
+		if err != nil {
+			return exec.LookPath(name)
+		}
+	}
+	return filepath.Abs(name)
+}
+
+/*
+ * Builds the environment for the program.
+ * Starts from the fuzzer's environment, or an empty one when clear is
+ * set, removes the variables named in unset then applies the
+ * "KEY=value" pairs in set.
+ */
+func buildEnv(clear bool, unset, set []string) []string {
+	env := []string{}
+	if !clear {
+		env = append(env, os.Environ()...)
+	}
+
+	remove := append([]string{}, unset...)
+	for _, kv := range set {
+		remove = append(remove, strings.SplitN(kv, "=", 2)[0])
+	}
+	kept := env[:0]
+	for _, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		drop := false
+		for _, r := range remove {
+			if key == r {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			kept = append(kept, kv)
+		}
+	}
+	return append(kept, set...)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"strings"
+)
+
+/*
+ * This file contains helpers used by the harness to decide whether
+ * a program run ended in a crash and what kind of crash it was.
+ */
+
+/*
+ * Details of a crashing program run.
+ * signal: signal which stopped or killed the program.
+ * class: human readable crash category derived from the signal.
+ * pcs: call stack addresses at the crash, innermost first.
+ * frames: pcs described as module relative offsets.
+ * signature: bucket the crash is deduplicated into.
+ * output: output the program wrote before crashing.
+ * snapshot: machine state at the crash, nil unless the program was
+ *           stopped at the crashing signal.
+ * triage: exploitability of the crash, see triage.go.
+ */
+type crashInfo struct {
+	signal    syscall.Signal
+	class     string
+	pcs       []uint64
+	frames    []string
+	signature string
+	output    runOutput
+	snapshot  *crashSnapshot
+	triage    triage
+}
+
+/*
+ * Crash categories for the signals which are treated as fatal.
+ */
+var crashClasses = map[syscall.Signal]string{
+	syscall.SIGSEGV: "segmentation fault",
+	syscall.SIGABRT: "abort",
+	syscall.SIGFPE:  "arithmetic error",
+	syscall.SIGILL:  "illegal instruction",
+	syscall.SIGBUS:  "bus error",
+	syscall.SIGTRAP: "trap",
+	syscall.SIGXFSZ: "file size limit exceeded",
+	syscall.SIGXCPU: "cpu time limit exceeded",
+}
+
+/*
+ * Checks whether a signal delivered to the program indicates a crash.
+ * Returns true for signals that the harness classifies as crashes.
+ */
+func isFatalSignal(sig syscall.Signal) bool {
+	_, ok := crashClasses[sig]
+	return ok
+}
+
+/*
+ * Checks whether a signal would put the program into a group-stop.
+ * These are not forwarded by the tracer as the harness does not
+ * resume group-stopped programs.
+ */
+func isStopSignal(sig syscall.Signal) bool {
+	switch sig {
+	case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		return true
+	}
+	return false
+}
+
+/*
+ * Returns the crash category for the given signal.
+ */
+func crashClassName(sig syscall.Signal) string {
+	if class, ok := crashClasses[sig]; ok {
+		return class
+	}
+	return "killed by " + syscall.SignalName(sig)
+}
+
+/*
+ * Inspects the final wait status of a program run.
+ * Programs stopped at delivery of a fatal signal and programs
+ * terminated by any signal are considered crashes.
+ * Returns the crash details and whether the run crashed.
+ */
+func classifyCrash(ws syscall.WaitStatus) (crashInfo, bool) {
+	var sig syscall.Signal
+	switch {
+	case ws.Stopped() && isFatalSignal(ws.StopSignal()):
+		sig = ws.StopSignal()
+	case ws.Signaled():
+		sig = ws.Signal()
+	default:
+		return crashInfo{}, false
+	}
+	crash := crashInfo{
+		signal:    sig,
+		class:     crashClassName(sig),
+		signature: stackSignature(sig, nil),
+	}
+	return crash, true
+}
+
+/*
+ * Records the call stack of a program stopped at a crash, keeping at
+ * most maxFrames frames, and buckets the crash by that stack.
+ * Crashes without a stack stay bucketed by their signal alone.
+ */
+func (c *crashInfo) collectStack(pid int, maxFrames int) error {
+	maps, err := readMaps(pid)
+	if err != nil {
+		return err
+	}
+	c.pcs, err = walkStack(pid, maps, maxFrames)
+	if err != nil {
+		return err
+	}
+	c.frames = symbolizeStack(maps, c.pcs)
+	c.signature = stackSignature(c.signal, c.frames)
+	return nil
+}
+
+/*
+ * Returns the crash details formatted for a crash report file.
+ */
+func (c crashInfo) report() string {
+	var b strings.Builder
+	if c.signal != 0 {
+		fmt.Fprintf(&b, "signal: %s\n", syscall.SignalName(c.signal))
+	}
+	fmt.Fprintf(&b, "class: %s\nsignature: %s\n", c.class, c.signature)
+	if c.triage.rank != "" {
+		fmt.Fprintf(&b, "triage: %s\n", c.triage.label())
+	}
+	if c.triage.instruction != "" {
+		fmt.Fprintf(&b, "instruction: %s\n", c.triage.instruction)
+	}
+	// Frames taken from a sanitizer report have no addresses.
+	for i, f := range c.frames {
+		if i < len(c.pcs) {
+			fmt.Fprintf(&b, "frame %d: 0x%x %s\n", i, c.pcs[i], f)
+		} else {
+			fmt.Fprintf(&b, "frame %d: %s\n", i, f)
+		}
+	}
+	if c.snapshot != nil {
+		b.WriteString(c.snapshot.report(c.signal))
+	}
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+/*
+ * This file contains the feedback shared by every harness, which
+ * decides whether a run showed behaviour not seen before anywhere in
+ * the campaign.
+ */
+
+/*
+ * Coverage measures runs can be compared by: exact syscall traces, the
+ * transition bitmap in bitmap.go, the basic blocks in blocks.go, or the
+ * edges instrumented programs count in the shared memory in shm.go.
+ */
+const (
+	coverageTrace  = "trace"
+	coverageBitmap = "bitmap"
+	coverageBlocks = "blocks"
+	coverageShm    = "shm"
+)
+
+/*
+ * Checks the coverage measure against the sandbox mode, as sandboxed
+ * programs can not attach the fuzzer's shared memory.
+ */
+func checkCoverageMode(mode string, sandbox string) error {
+	switch mode {
+	case coverageTrace, coverageBitmap, coverageBlocks:
+		return nil
+	case coverageShm:
+		if sandbox != "" {
+			return fmt.Errorf("%s coverage can not be combined with a sandbox", coverageShm)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown coverage %q, expected %s, %s, %s or %s",
+		mode, coverageTrace, coverageBitmap, coverageBlocks, coverageShm)
+}
+
+/*
+ * Behaviour seen by all harnesses, safe for concurrent use.
+ * mode: coverage measure runs are compared by.
+ * traces: fingerprints of the unique traces seen, in trace mode.
+ * buckets: hit count buckets seen for each bitmap counter, as a bit
+ *          per bucket, in bitmap and shm mode.
+ * edges: number of bitmap counters which have been hit.
+ * blocks: basic blocks of the program, in blocks mode.
+ */
+type feedbackManager struct {
+	mu      sync.Mutex
+	mode    string
+	traces  *traceSet
+	buckets [bitmapSize]uint8
+	edges   int
+	blocks  *blockCoverage
+}
+
+/*
+ * Creates the feedback for a campaign fuzzing the program at path,
+ * which is only read in blocks mode.
+ */
+func newFeedbackManager(mode string, path string) (*feedbackManager, error) {
+	m := &feedbackManager{mode: mode, traces: newTraceSet()}
+	if mode == coverageBlocks {
+		var err error
+		m.blocks, err = loadBlockCoverage(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+/*
+ * Records the trace of a run. Of several harnesses finding the same
+ * behaviour, exactly one is told it is new.
+ * Returns whether the run showed behaviour no harness had seen before:
+ * a new trace, in bitmap mode a new transition or hit count bucket, in
+ * blocks mode a new basic block, or in shm mode a new edge or hit count
+ * bucket.
+ */
+func (m *feedbackManager) addRun(t execTrace) bool {
+	switch m.mode {
+	case coverageBitmap:
+		return m.addBitmap(syscallBitmap(t))
+	case coverageBlocks:
+		return m.blocks.add(t.blocks)
+	case coverageShm:
+		// Runs which never got to count edges show nothing new.
+		if t.edges == nil {
+			return false
+		}
+		return m.addBitmap(t.edges)
+	}
+	// Hash outside of the lock, which only guards the set.
+	f := fingerprint(t)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.traces.add(f)
+}
+
+/*
+ * Merges the bitmap of a run into the buckets seen.
+ * Returns whether it set a bucket which had not been seen.
+ */
+func (m *feedbackManager) addBitmap(b *transitionBitmap) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for i, count := range b {
+		bucket := countBucket(count)
+		if bucket == 0 || m.buckets[i]&bucket != 0 {
+			continue
+		}
+		if m.buckets[i] == 0 {
+			m.edges++
+		}
+		m.buckets[i] |= bucket
+		found = true
+	}
+	return found
+}
+
+/*
+ * Describes the behaviour seen by all harnesses, e.g. "12 unique
+ * traces" or "80 edges".
+ */
+func (m *feedbackManager) summary() string {
+	if m.blocks != nil {
+		return m.blocks.summary()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mode == coverageBitmap || m.mode == coverageShm {
+		return fmt.Sprintf("%d edges", m.edges)
+	}
+	return fmt.Sprintf("%d unique traces", m.traces.size())
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This file contains the fork server execution mode. The target is
+ * started once and stopped at an entry point, after which a copy of
+ * the stopped process is forked off for every input. Dynamic loading
+ * and libc initialisation are then only paid for once.
+ */
+
+/*
+ * Machine code placed at the entry point of the fork server:
+ * syscall; int3. Syscalls are injected by pointing the instruction
+ * pointer at it, the int3 returns control to the harness afterwards.
+ */
+var syscallStub = []byte{0x0f, 0x05, 0xcc}
+
+/*
+ * A target process stopped at its entry point, used to fork off
+ * processes to run inputs in.
+ * pid: pid of the stopped server process.
+ * entry: address the server is stopped at.
+ * regs: registers of the server at the entry point.
+ * code: original code at entry which the syscall stub replaced.
+ */
+type forkServer struct {
+	pid   int
+	entry uintptr
+	regs  syscall.PtraceRegs
+	code  []byte
+}
+
+/*
+ * Starts the fork server for the program in cfg and runs it up to the
+ * function named by cfg.forkServerEntry. The server's stdin is read from
+ * stdin, its output is written to capture and inputPath replaces
+ * inputPlaceholder in its arguments.
+ * Must be called from, and the server only used from, a locked OS thread.
+ */
+func startForkServer(cfg *harnessConfig, stdin *os.File, capture *outputCapture,
+	inputPath string) (*forkServer, error) {
+	pid, err := startServerProcess(cfg, stdin, capture, inputPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &forkServer{pid: pid}
+
+	s.entry, _, err = resolveAddress(cfg.cmd, cfg.forkServerEntry, s.pid)
+	if err != nil {
+		s.stop()
+		return nil, err
+	}
+	err = s.runToEntry()
+	if err != nil {
+		s.stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+ * Starts the program in cfg as a long running server for a fork server
+ * or snapshot, reading stdin and writing its output to capture.
+ * Returns the pid of the program, stopped and with traceOptions and
+ * its resource limits set.
+ */
+func startServerProcess(cfg *harnessConfig, stdin *os.File, capture *outputCapture,
+	inputPath string) (int, error) {
+	procCmd := targetCommand(cfg, cfg.targetArgs(inputPath))
+	procCmd.Env = cfg.env
+	procCmd.Dir = cfg.dir
+	procCmd.Stdin = stdin
+	procCmd.Stdout = capture.stdout.w
+	procCmd.Stderr = capture.stderr.w
+	err := procCmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	pid := procCmd.Process.Pid
+	trackProgram(pid)
+
+	// Child process recieves signal on startup.
+	var ws syscall.WaitStatus
+	_, err = syscall.Wait4(pid, &ws, syscall.WALL, nil)
+	if err == nil {
+		err = syscall.PtraceSetOptions(pid, traceOptions)
+	}
+	if err == nil {
+		// Copies of the server inherit its limits.
+		err = applyRlimits(pid, cfg.rlimits)
+	}
+	if err != nil {
+		killProgram(pid)
+		return 0, err
+	}
+	return pid, nil
+}
+
+/*
+ * Finds the run time address of spec in the program at path running as
+ * pid, adjusting for where position independent executables were
+ * loaded. spec is either the name of a function or object, or a hex
+ * address such as 0x401136 as shown by objdump.
+ * Returns the address and the size of the symbol, zero for addresses.
+ */
+func resolveAddress(path, spec string, pid int) (uintptr, uint64, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	addr, size, err := lookupSymbol(f, spec)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s in %s", err.Error(), path)
+	}
+	loaded, err := relocate(f, path, addr, pid)
+	return loaded, size, err
+}
+
+/*
+ * Finds the link time address and size of spec, a symbol name or hex
+ * address, in f.
+ */
+func lookupSymbol(f *elf.File, spec string) (uint64, uint64, error) {
+	if strings.HasPrefix(spec, "0x") {
+		addr, err := strconv.ParseUint(spec[2:], 16, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid address %s", spec)
+		}
+		return addr, 0, nil
+	}
+
+	syms, _ := f.Symbols()
+	dynSyms, _ := f.DynamicSymbols()
+	for _, sym := range append(syms, dynSyms...) {
+		kind := elf.ST_TYPE(sym.Info)
+		if sym.Name == spec && (kind == elf.STT_FUNC || kind == elf.STT_OBJECT) &&
+			sym.Value != 0 {
+			return sym.Value, sym.Size, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("symbol %s not found", spec)
+}
+
+/*
+ * Converts the link time address addr in f, the program at path running
+ * as pid, to its run time address.
+ */
+func relocate(f *elf.File, path string, addr uint64, pid int) (uintptr, error) {
+	if f.Type != elf.ET_DYN {
+		return uintptr(addr), nil
+	}
+
+	maps, err := readMaps(pid)
+	if err != nil {
+		return 0, err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return 0, err
+	}
+	base := moduleBase(maps, realPath)
+	if base == 0 {
+		return 0, fmt.Errorf("%s is not mapped in process %d", realPath, pid)
+	}
+	// The lowest segment is mapped at the load base.
+	var lowest uint64 = ^uint64(0)
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Vaddr < lowest {
+			lowest = p.Vaddr
+		}
+	}
+	return uintptr(base + addr - lowest&^0xfff), nil
+}
+
+/*
+ * Runs the stopped server up to a breakpoint at its entry point and
+ * replaces the code there with syscallStub.
+ */
+func (s *forkServer) runToEntry() error {
+	s.code = make([]byte, len(syscallStub))
+	_, err := syscall.PtracePeekData(s.pid, s.entry, s.code)
+	if err != nil {
+		return err
+	}
+	s.regs, err = runToBreakpoint(s.pid, s.entry)
+	if err != nil {
+		return err
+	}
+	_, err = syscall.PtracePokeData(s.pid, s.entry, syscallStub)
+	return err
+}
+
+/*
+ * Runs the stopped process pid up to a one-shot breakpoint at addr,
+ * passing on the signals it receives on the way.
+ * Returns the registers of the process stopped at addr, with the
+ * original code restored.
+ */
+func runToBreakpoint(pid int, addr uintptr) (syscall.PtraceRegs, error) {
+	var regs syscall.PtraceRegs
+	code := make([]byte, 1)
+	_, err := syscall.PtracePeekData(pid, addr, code)
+	if err != nil {
+		return regs, err
+	}
+	_, err = syscall.PtracePokeData(pid, addr, []byte{0xcc})
+	if err != nil {
+		return regs, err
+	}
+
+	var ws syscall.WaitStatus
+	sig := 0
+	for {
+		err = syscall.PtraceCont(pid, sig)
+		if err != nil {
+			return regs, err
+		}
+		_, err = syscall.Wait4(pid, &ws, syscall.WALL, nil)
+		if err != nil {
+			return regs, err
+		}
+		if ws.Exited() || ws.Signaled() {
+			return regs, fmt.Errorf("program exited before reaching 0x%x", addr)
+		}
+		sig = 0
+		if ws.StopSignal() == syscall.SIGTRAP {
+			if ws.TrapCause() > 0 {
+				continue
+			}
+			break
+		}
+		if !isStopSignal(ws.StopSignal()) {
+			sig = int(ws.StopSignal())
+		}
+	}
+
+	err = syscall.PtraceGetRegs(pid, &regs)
+	if err != nil {
+		return regs, err
+	}
+	// The breakpoint leaves the instruction pointer just past it.
+	regs.Rip--
+	if uintptr(regs.Rip) != addr {
+		return regs, fmt.Errorf("program stopped at 0x%x instead of 0x%x", regs.Rip, addr)
+	}
+	_, err = syscall.PtracePokeData(pid, addr, code)
+	return regs, err
+}
+
+/*
+ * Runs a syscall in a stopped process through the syscall stub at the
+ * server's entry point. Any fork the syscall makes is reported through
+ * the PTRACE_EVENT_FORK stop and its pid returned as child.
+ * Returns the syscall's return value and the forked pid, if any.
+ */
+func (s *forkServer) injectSyscall(pid int, nr uint64, args ...uint64) (uint64, int, error) {
+	return injectSyscall(pid, s.regs, s.entry, nr, args...)
+}
+
+/*
+ * Runs a syscall in the stopped process pid through a syscallStub
+ * placed at stub, starting from the registers in base.
+ * Returns the syscall's return value and the pid forked by it, if any.
+ */
+func injectSyscall(pid int, base syscall.PtraceRegs, stub uintptr, nr uint64,
+	args ...uint64) (uint64, int, error) {
+	regs := base
+	regs.Rip = uint64(stub)
+	regs.Rax = nr
+	argRegs := []*uint64{&regs.Rdi, &regs.Rsi, &regs.Rdx, &regs.R10, &regs.R8, &regs.R9}
+	for i, r := range argRegs {
+		*r = 0
+		if i < len(args) {
+			*r = args[i]
+		}
+	}
+	err := syscall.PtraceSetRegs(pid, &regs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var ws syscall.WaitStatus
+	child := 0
+	for {
+		err = syscall.PtraceCont(pid, 0)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = syscall.Wait4(pid, &ws, syscall.WALL, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ws.Exited() || ws.Signaled() || isFatalSignal(ws.StopSignal()) &&
+			ws.StopSignal() != syscall.SIGTRAP {
+			return 0, 0, fmt.Errorf("process %d died injecting syscall %d", pid, nr)
+		}
+		// Other signals, such as SIGCHLD from finished runs, are dropped.
+		if ws.StopSignal() != syscall.SIGTRAP {
+			continue
+		}
+		if ws.TrapCause() == syscall.PTRACE_EVENT_FORK {
+			msg, err := syscall.PtraceGetEventMsg(pid)
+			if err != nil {
+				return 0, 0, err
+			}
+			child = int(msg)
+			continue
+		}
+		break
+	}
+
+	err = syscall.PtraceGetRegs(pid, &regs)
+	if err != nil {
+		return 0, 0, err
+	}
+	return regs.Rax, child, nil
+}
+
+/*
+ * Forks a copy of the server stopped at the entry point.
+ * The copy is traced with traceOptions, runs in its own process group
+ * and is left in the state traceSyscalls expects to start from.
+ * Returns the pid of the copy.
+ */
+func (s *forkServer) fork() (int, error) {
+	ret, child, err := s.injectSyscall(s.pid, syscall.SYS_FORK)
+	if err != nil {
+		return 0, err
+	}
+	if child == 0 {
+		return 0, fmt.Errorf("fork server failed to fork: %s",
+			syscall.Errno(uintptr(-int64(ret))).Error())
+	}
+
+	// Traced children start with a SIGSTOP.
+	trackProgram(child)
+	var ws syscall.WaitStatus
+	_, err = syscall.Wait4(child, &ws, syscall.WALL, nil)
+	if err != nil {
+		killProgram(child)
+		return 0, err
+	}
+
+	// Move the child into its own process group, then restore the
+	// code and registers it had at the entry point.
+	_, _, err = s.injectSyscall(child, syscall.SYS_SETPGID, 0, 0)
+	if err == nil {
+		_, err = syscall.PtracePokeData(child, s.entry, s.code)
+	}
+	if err == nil {
+		err = syscall.PtraceSetRegs(child, &s.regs)
+	}
+	if err != nil {
+		killProgram(child)
+		return 0, err
+	}
+	return child, nil
+}
+
+/*
+ * Forks a copy of the server to run input, which is written to
+ * inputFile. The server reads inputFile as its stdin, and its copies
+ * share the file offset, so it is rewound for every run.
+ * Returns the pid of the copy, ready for traceSyscalls.
+ */
+func (s *forkServer) run(inputFile *os.File, input []byte) (int, error) {
+	err := writeInputFile(inputFile, input)
+	if err != nil {
+		return 0, err
+	}
+	_, err = inputFile.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+	return s.fork()
+}
+
+/*
+ * Reaps the finished copies of the server. The harness collects their
+ * status as their tracer, but only the server as their parent can
+ * remove them from the process table.
+ */
+func (s *forkServer) reap() error {
+	for {
+		ret, _, err := s.injectSyscall(s.pid, syscall.SYS_WAIT4,
+			^uint64(0), 0, syscall.WNOHANG)
+		if err != nil {
+			return err
+		}
+		// Stop once no finished children or no children remain.
+		if int64(ret) <= 0 {
+			return nil
+		}
+	}
+}
+
+/*
+ * Kills the server process.
+ */
+func (s *forkServer) stop() {
+	killProgram(s.pid)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	syscall "golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+/*
+ * Program run by the execution benchmarks, which reads its input and
+ * exits like a small parser.
+ */
+const benchTarget = `
+#include <unistd.h>
+int main(void) {
+	char buf[64];
+	return read(0, buf, sizeof buf) > 0 && buf[0] == 'X';
+}
+`
+
+/*
+ * Compiles benchTarget into dir, skipping the benchmark without a C
+ * compiler.
+ * Returns the path of the program.
+ */
+func buildBenchTarget(b *testing.B, dir string) string {
+	src := filepath.Join(dir, "target.c")
+	err := ioutil.WriteFile(src, []byte(benchTarget), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := filepath.Join(dir, "target")
+	out, err := exec.Command("cc", "-O1", "-o", path, src).CombinedOutput()
+	if err != nil {
+		b.Skipf("cannot compile target: %s: %s", err, out)
+	}
+	return path
+}
+
+/*
+ * Compares starting the program for every input with forking it from
+ * a fork server. Both run the same input under the same tracing as the
+ * harness, so the difference is the cost of exec and startup.
+ */
+func BenchmarkExec(b *testing.B) {
+	dir, err := ioutil.TempDir("", "fuzzer-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &harnessConfig{cmd: buildBenchTarget(b, dir), env: os.Environ(),
+		forkServerEntry: "main"}
+	input := []byte("benchmark input")
+
+	b.Run("startProgram", func(b *testing.B) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		capture, err := newOutputCapture(4096)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer capture.close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			pid, err := startProgram(cfg, nil, capture, input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchTrace(b, pid)
+		}
+	})
+
+	b.Run("forkServer", func(b *testing.B) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		capture, err := newOutputCapture(4096)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer capture.close()
+		inputFile, err := ioutil.TempFile(dir, "input-")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer inputFile.Close()
+		server, err := startForkServer(cfg, inputFile, capture, inputFile.Name())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer server.stop()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			pid, err := server.run(inputFile, input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchTrace(b, pid)
+			err = server.reap()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+/*
+ * Traces a started program to its exit as the harness does.
+ */
+func benchTrace(b *testing.B, pid int) {
+	var ws syscall.WaitStatus
+	wd := startWatchdog(pid, 0)
+	_, _, _, err := traceSyscalls(pid, &ws, 0, false, nil, wd)
+	wd.stop()
+	killProgram(pid)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
@@ -1,156 +1,932 @@
 package main
 
 import (
+	"fmt"
 	syscall "golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+	"unsafe"
 )
 
 /*
- * Traps on every program syscall entry/exit and records the state.
- * Function should be called after the child process has been started
- * with ptrace enabled and has had syscall.Wait4 called on it once.
- * Continues program until exit or crash: ws will be updated with the status.
- * Takes as arguments the pid of process to trace and WaitStatus to update.
- * Returns an execTrace struct identifying the execution run.
+ * Options set on every traced program. Syscall stops are marked so they
+ * can be told apart from SIGTRAP, every task the program creates is
+ * traced as well and tasks stop before they exit. Programs are killed
+ * if the fuzzer exits.
  */
-func traceSyscalls(pid int, ws *syscall.WaitStatus) execTrace {
+const traceOptions = syscall.PTRACE_O_TRACESYSGOOD |
+	syscall.PTRACE_O_TRACEFORK | syscall.PTRACE_O_TRACEVFORK |
+	syscall.PTRACE_O_TRACECLONE | syscall.PTRACE_O_TRACEEXEC |
+	syscall.PTRACE_O_TRACEEXIT | syscall.PTRACE_O_EXITKILL
+
+/*
+ * Traps on every syscall entry/exit of every task in the program and
+ * records the state.
+ * Function should be called from the thread which started the child
+ * process with ptrace enabled, after it has had syscall.Wait4 called on
+ * it once and has had traceOptions set. Every task the program creates
+ * is recorded with its tracked tasks, see trackProgram.
+ * Continues program until all of its tasks exit, any task crashes or
+ * until maxSyscalls syscalls have been made: ws will be updated with the
+ * status of the crashed task or otherwise of the program itself.
+ * Non fatal signals are passed on to the task receiving them.
+ * Takes as arguments the pid of process to trace, WaitStatus to update,
+ * the syscall limit, where zero means no limit, whether to stop the
+ * program on entry to exit_group rather than let it exit, the block
+ * coverage breakpoints planted in it, if any, and the watchdog of the
+ * run, which is disarmed once every task is exiting.
+ * Returns an execTrace struct identifying the execution run, the pid of
+ * the task ws belongs to, whether the syscall limit was hit and any
+ * ptrace error, after which the program should be killed. The program
+ * is left stopped on a crash, when the limit is hit or at exit_group.
+ */
+func traceSyscalls(pid int, ws *syscall.WaitStatus, maxSyscalls int,
+	stopAtExit bool, traps *blockTraps, wd *watchdog) (execTrace, int, bool, error) {
 	var err error
 	var regs syscall.PtraceRegs
 	var curExecTrace execTrace
+	var status syscall.WaitStatus
+
+	// Live tasks of the program, numbered in the order they were seen.
+	tasks := map[int]int{pid: 0}
+	// Tasks stopped on their way out, which can no longer run.
+	exiting := map[int]bool{}
+	nextTask := 1
+	program := trackedTasks(pid)
+	addTask := func(tid int) {
+		if _, ok := tasks[tid]; !ok {
+			tasks[tid] = nextTask
+			nextTask++
+			program.add(tid)
+		}
+	}
+	removeTask := func(tid int) {
+		delete(tasks, tid)
+		delete(exiting, tid)
+		program.remove(tid)
+	}
+
+	tid, sig := pid, 0
 	for {
-		err = syscall.PtraceSyscall(pid, 0)
-		if err != nil {
-			log.Fatal("traceSyscalls failed to call PtraceSyscall")
+		err = syscall.PtraceSyscall(tid, sig)
+		// A task killed while stopped has its status collected by Wait4.
+		if err != nil && err != syscall.ESRCH {
+			return curExecTrace, pid, false,
+				fmt.Errorf("traceSyscalls failed to call PtraceSyscall: %s", err.Error())
 		}
+		sig = 0
 
-		_, err = syscall.Wait4(pid, ws, syscall.WALL, nil)
-		if err != nil {
-			log.Fatal("traceSyscalls failed to call Wait4")
+		// Wait for the next event from any task traced by this thread,
+		// skipping over tasks which exit. Tasks may have left the
+		// program's process group, so they are not waited for by it.
+		for {
+			tid, err = syscall.Wait4(-1, &status, syscall.WALL|syscall.WNOTHREAD, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			// Every task has exited.
+			if err == syscall.ECHILD {
+				return curExecTrace, pid, false, nil
+			}
+			if err != nil {
+				return curExecTrace, pid, false,
+					fmt.Errorf("traceSyscalls failed to call Wait4: %s", err.Error())
+			}
+			if !status.Exited() && !status.Signaled() {
+				break
+			}
+
+			removeTask(tid)
+			if tid == pid {
+				*ws = status
+			}
+			// Return on any task being killed by a crash.
+			if _, crashed := classifyCrash(status); crashed {
+				*ws = status
+				return curExecTrace, tid, false, nil
+			}
+			if len(tasks) == 0 {
+				return curExecTrace, pid, false, nil
+			}
 		}
 
-		// Return on program exit or crash.
-		if ws.Exited() == true || ws.StopSignal() == syscall.SIGSEGV {
-			return curExecTrace
+		// The first stop of a new task may arrive before the event
+		// announcing it.
+		addTask(tid)
+
+		stopSig := status.StopSignal()
+		if stopSig != syscall.SIGTRAP|0x80 {
+			// Ptrace event stops: track tasks the program creates.
+			if stopSig == syscall.SIGTRAP && status.TrapCause() > 0 {
+				msg, err := syscall.PtraceGetEventMsg(tid)
+				if err != nil {
+					continue
+				}
+				switch status.TrapCause() {
+				case syscall.PTRACE_EVENT_FORK, syscall.PTRACE_EVENT_VFORK,
+					syscall.PTRACE_EVENT_CLONE:
+					addTask(int(msg))
+				case syscall.PTRACE_EVENT_EXEC:
+					// A thread calling exec takes over the leader's tid.
+					if int(msg) != tid {
+						removeTask(int(msg))
+					}
+				case syscall.PTRACE_EVENT_EXIT:
+					// Once the last task is reaped its tid may be reused,
+					// so the watchdog must not fire after.
+					exiting[tid] = true
+					if len(exiting) == len(tasks) {
+						wd.disarm()
+					}
+				}
+				continue
+			}
+			// Block coverage breakpoints are not signals to the program.
+			if stopSig == syscall.SIGTRAP && traps != nil {
+				block, ok, err := traps.hit(tid)
+				if err != nil && err != syscall.ESRCH {
+					return curExecTrace, pid, false,
+						fmt.Errorf("traceSyscalls failed to handle breakpoint: %s", err.Error())
+				}
+				if ok {
+					curExecTrace.blocks = append(curExecTrace.blocks, block)
+					continue
+				}
+			}
+			// Signal delivery stop: return on crash, otherwise
+			// deliver the signal when resuming.
+			if isFatalSignal(stopSig) {
+				*ws = status
+				return curExecTrace, tid, false, nil
+			}
+			if !isStopSignal(stopSig) {
+				sig = int(stopSig)
+			}
+			continue
 		}
 
 		// Collect trace information.
-		err = syscall.PtraceGetRegs(pid, &regs)
+		err = syscall.PtraceGetRegs(tid, &regs)
+		if err == syscall.ESRCH {
+			continue
+		}
 		if err != nil {
-			log.Fatal("traceSyscalls failed to call PtraceGetRegs")
+			return curExecTrace, pid, false,
+				fmt.Errorf("traceSyscalls failed to call PtraceGetRegs: %s", err.Error())
 		}
 
-		traceRegs := getInterestingRegs(&regs)
+		var exit bool
+		exit, err = isSyscallExit(tid, &regs)
+		if err == syscall.ESRCH {
+			continue
+		}
+		if err != nil {
+			return curExecTrace, pid, false,
+				fmt.Errorf("traceSyscalls failed to read syscall info: %s", err.Error())
+		}
+		// A rewound snapshot abandons the syscall it was stopped in,
+		// which then stops on exit without having run.
+		if exit && int64(regs.Orig_rax) == -1 {
+			continue
+		}
+		traceRegs := getInterestingRegs(&regs, tasks[tid], exit)
 		curExecTrace.trace = append(curExecTrace.trace, traceRegs)
+		if exit && curExecTrace.limitErr == 0 {
+			curExecTrace.limitErr = getLimitErr(&regs)
+		}
+
+		// exit_group does not return, so this is its entry.
+		if stopAtExit && !exit && tid == pid && regs.Orig_rax == syscall.SYS_EXIT_GROUP {
+			*ws = status
+			return curExecTrace, pid, false, nil
+		}
+
+		// Every syscall is trapped on both entry and exit.
+		if maxSyscalls > 0 && len(curExecTrace.trace) >= 2*maxSyscalls {
+			*ws = status
+			return curExecTrace, tid, true, nil
+		}
+	}
+}
+
+/*
+ * Checks whether task tid, in a syscall stop with registers regs, is
+ * stopped on exit from a syscall rather than on entry to one. Stops do
+ * not always alternate from an entry, as rewinding a snapshot leaves a
+ * syscall which was entered without stopping on its exit.
+ */
+func isSyscallExit(tid int, regs *syscall.PtraceRegs) (bool, error) {
+	// x/sys has no wrapper for PTRACE_GET_SYSCALL_INFO. The kernel
+	// writes as much of its info as fits, which starts with the op.
+	var op uint8
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GET_SYSCALL_INFO,
+		uintptr(tid), unsafe.Sizeof(op), uintptr(unsafe.Pointer(&op)), 0, 0)
+	// Kernels before 5.3 lack the request, but enter syscalls with
+	// -ENOSYS in rax.
+	if errno == syscall.EIO {
+		return int64(regs.Rax) != -int64(syscall.ENOSYS), nil
+	}
+	if errno != 0 {
+		return false, errno
 	}
+	return op == syscall.PTRACE_SYSCALL_INFO_EXIT, nil
 }
 
 /*
- * Harness will run the external binary specified by cmd and feed
- * it inputs from the inputCases channel. Interesting TestCases will
- * be placed in the interestCases output channel.
+ * Kills a program which runs for longer than its allowed time.
+ * timer: timer killing the program, nil without a timeout.
+ * mu: guards armed and fired against the timer.
+ * armed: whether the timer may still kill the program.
+ * fired: whether the timer killed the program.
  */
-func harness(id int, cmd string,
-	inputCases <-chan TestCase,
+type watchdog struct {
+	timer *time.Timer
+	mu    sync.Mutex
+	armed bool
+	fired bool
+}
+
+/*
+ * Starts a watchdog which sends SIGKILL to every task of the program
+ * started as pid once timeout has passed. A zero timeout creates a
+ * watchdog which never fires.
+ */
+func startWatchdog(pid int, timeout time.Duration) *watchdog {
+	w := &watchdog{armed: true}
+	if timeout > 0 {
+		tasks := trackedTasks(pid)
+		w.timer = time.AfterFunc(timeout, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.armed {
+				w.fired = true
+				tasks.kill()
+			}
+		})
+	}
+	return w
+}
+
+/*
+ * Keeps the watchdog from firing from now on, e.g. once the program is
+ * exiting and about to be reaped.
+ */
+func (w *watchdog) disarm() {
+	w.mu.Lock()
+	w.armed = false
+	w.mu.Unlock()
+}
+
+/*
+ * Stops the watchdog.
+ * Returns whether it fired and killed the program.
+ */
+func (w *watchdog) stop() bool {
+	w.disarm()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fired
+}
+
+/*
+ * Number of times a failed run is retried before its input is dropped,
+ * the number of inputs in a row which may fail before a harness is
+ * restarted, and the pause before it is, which doubles while restarts
+ * keep following each other up to the maximum.
+ */
+const (
+	runRetries             = 2
+	maxConsecutiveErrors   = 10
+	harnessRestartDelay    = time.Second
+	maxHarnessRestartDelay = time.Minute
+)
+
+/*
+ * Runs the binary in cfg on inputs from inputCases, given on stdin or
+ * through inputPlaceholder. Interesting inputs are sent to
+ * interestCases, and crashes and hangs are saved in store.
+ * The harness is set up again when runs keep failing or it panics.
+ * Returns once inputCases is closed.
+ */
+func harness(id int, cfg *harnessConfig, store *findingStore,
+	feedback *feedbackManager, inputCases <-chan TestCase,
 	interestCases chan<- TestCase) {
 
-	// List of unique execution traces for this harness.
-	var uniqueTraces []execTrace
+	delay := harnessRestartDelay
+	for {
+		h := &harnessState{id: id, cfg: cfg, store: store, feedback: feedback,
+			interestCases: interestCases}
+		started := time.Now()
+		err := h.supervise(inputCases)
+		if err == nil {
+			return
+		}
+		// A harness which ran for a while before failing starts over
+		// with a short pause.
+		if time.Since(started) > maxHarnessRestartDelay {
+			delay = harnessRestartDelay
+		}
+		countRestart(id)
+		log.Printf("Harness with id %d restarting in %s: %s\n", id, delay, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxHarnessRestartDelay {
+			delay = maxHarnessRestartDelay
+		}
+	}
+}
 
-	for inputCase := range inputCases {
-		var err error
-		procCmd := exec.Command(cmd)
-		procCmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
-		procStdin, err := procCmd.StdinPipe()
+/*
+ * Runs inputs as runInputs does, turning a panic of the harness into
+ * an error so it is restarted instead of taking down the fuzzer.
+ */
+func (h *harnessState) supervise(inputCases <-chan TestCase) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return h.runInputs(inputCases)
+}
+
+/*
+ * Resources of a harness which are set up again when it restarts.
+ * id: id of the harness, used in logs and statistics.
+ * cfg: how the program is run.
+ * store: where findings are saved.
+ * feedback: behaviour seen by every harness.
+ * inputFile: file inputs are written to, nil when passed on stdin.
+ * capture: files the program's output is written to.
+ * server: fork server inputs are run in, nil when not used.
+ * snapshot: snapshot inputs are run from, nil when not used or until
+ *           it is taken on the first run.
+ * freshSnapshots: whether a snapshot is taken for every input, as the
+ *                 program can not be rewound to one.
+ * shm: bitmap instrumented programs count edges in, nil when not used.
+ * interestCases: channel interesting inputs are sent to.
+ */
+type harnessState struct {
+	id             int
+	cfg            *harnessConfig
+	store          *findingStore
+	feedback       *feedbackManager
+	inputFile      *os.File
+	capture        *outputCapture
+	server         *forkServer
+	snapshot       *snapshotServer
+	freshSnapshots bool
+	shm            *shmCoverage
+	interestCases  chan<- TestCase
+}
+
+/*
+ * Result of running the program on one input.
+ * pid: pid of the program.
+ * ws: status of the crashed task, or otherwise of the program.
+ * trace: the syscalls the program made.
+ * crash: details of the crash, if crashed.
+ * crashed: whether the program crashed.
+ * crashPid: pid of the crashed task.
+ * hung: whether the program was killed for exceeding its limits.
+ */
+type execResult struct {
+	pid      int
+	ws       syscall.WaitStatus
+	trace    execTrace
+	crash    crashInfo
+	crashed  bool
+	crashPid int
+	hung     bool
+}
+
+/*
+ * Sets up the harness and runs every input from inputCases.
+ * Returns nil once inputCases is closed, or an error once the harness
+ * can not be set up or runs keep failing.
+ */
+func (h *harnessState) runInputs(inputCases <-chan TestCase) error {
+	// Inputs passed as a file, or to a fork server or snapshot, are
+	// written to a file private to this harness.
+	var err error
+	snapshots := h.cfg.snapshotPoint != ""
+	if h.cfg.usesInputFile() || h.cfg.forkServer || snapshots {
+		h.inputFile, err = ioutil.TempFile("", fmt.Sprintf("fuzzer-input-%d-", h.id))
 		if err != nil {
-			log.Fatalf("Harness with id %d failed to connect stdin pipe: %s\n",
-				id, err.Error())
+			return fmt.Errorf("failed to create input file: %s", err.Error())
 		}
+		trackTempPath(h.inputFile.Name())
+		defer removeTempPath(h.inputFile.Name())
+		defer h.inputFile.Close()
+	}
+
+	h.capture, err = newOutputCapture(h.cfg.outputLimit)
+	if err != nil {
+		return fmt.Errorf("failed to create output pipes: %s", err.Error())
+	}
+	defer h.capture.close()
+
+	if h.feedback.mode == coverageShm {
+		h.shm, err = newShmCoverage()
+		if err != nil {
+			return fmt.Errorf("failed to create coverage bitmap: %s", err.Error())
+		}
+		defer h.shm.close()
+		// Every program this harness starts is given its bitmap.
+		cfg := *h.cfg
+		cfg.env = append(append([]string{}, cfg.env...), h.shm.env())
+		h.cfg = &cfg
+	}
 
-		// Lock OS thread as per syscall.SysProcAttr documentation.
+	if h.cfg.forkServer {
+		// The server is traced by this thread and may only be used from it.
 		runtime.LockOSThread()
-		err = procCmd.Start()
+		defer runtime.UnlockOSThread()
+		h.server, err = startForkServer(h.cfg, h.inputFile, h.capture, h.inputFile.Name())
 		if err != nil {
-			log.Fatalf("Harness with id %d failed to start program: %s\n",
-				id, err.Error())
+			return fmt.Errorf("failed to start fork server: %s", err.Error())
+		}
+		defer h.server.stop()
+	}
+	if snapshots {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer h.dropSnapshot()
+	}
+
+	consecutiveErrors := 0
+	for inputCase := range inputCases {
+		var res execResult
+		for attempt := 0; attempt <= runRetries; attempt++ {
+			res, err = h.execute(inputCase.input)
+			if err == nil {
+				break
+			}
+			countError(h.id)
+			log.Printf("Harness with id %d failed to run input: %s\n", h.id, err.Error())
+			// The state of the fork server is unknown after a failure.
+			if h.server != nil {
+				return err
+			}
 		}
+		if err != nil {
+			consecutiveErrors++
+			if consecutiveErrors >= maxConsecutiveErrors {
+				return fmt.Errorf("%d inputs in a row failed", consecutiveErrors)
+			}
+			continue
+		}
+		consecutiveErrors = 0
+		h.report(inputCase, res)
+	}
+	return nil
+}
 
-		procPid := procCmd.Process.Pid
+/*
+ * Runs the program on input and traces it.
+ * Returns the outcome of the run. On error the program has been killed
+ * and the input may be run again.
+ */
+func (h *harnessState) execute(input []byte) (execResult, error) {
+	var res execResult
+	var err error
 
-		// Child process recieves signal on startup.
-		var ws syscall.WaitStatus
-		_, err = syscall.Wait4(procPid, &ws, syscall.WALL, nil)
+	// Lock OS thread as per syscall.SysProcAttr documentation.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// The program would be left stopped if the harness panicked.
+	defer func() {
+		if r := recover(); r != nil {
+			if res.pid != 0 {
+				killProgram(res.pid)
+			}
+			panic(r)
+		}
+	}()
+	h.capture.reset()
+	// Servers get their input over the network and nothing on stdin.
+	stdinInput := input
+	if h.cfg.netProto != "" {
+		stdinInput = nil
+	}
+	if h.shm != nil {
+		h.shm.reset()
+	}
+	switch {
+	case h.server != nil:
+		res.pid, err = h.server.run(h.inputFile, stdinInput)
+	case h.cfg.snapshotPoint != "":
+		res.pid, err = h.runSnapshot(input)
+	default:
+		res.pid, err = startProgram(h.cfg, h.inputFile, h.capture, stdinInput)
+	}
+	if err != nil {
+		return res, fmt.Errorf("failed to start program: %s", err.Error())
+	}
+	var traps *blockTraps
+	if h.feedback.blocks != nil {
+		traps, err = h.feedback.blocks.plant(res.pid)
+		// Breakpoints are written over the snapshot's syscall stub.
+		if err == nil && h.snapshot != nil {
+			err = h.snapshot.placeStub()
+		}
 		if err != nil {
-			log.Fatalf("Harness with id %d failed to wait: %s\n",
-				id, err.Error())
+			killProgram(res.pid)
+			if h.server != nil {
+				h.server.reap()
+			}
+			h.dropSnapshot()
+			return res, err
 		}
+	}
 
-		_, err = procStdin.Write(inputCase.input)
+	// Trace execution and report back interesting cases.
+	wd := startWatchdog(res.pid, h.cfg.timeout)
+	var exchange *netExchange
+	if h.cfg.netProto != "" {
+		exchange = startExchange(h.cfg, res.pid, input)
+	}
+	var hitLimit bool
+	res.trace, res.crashPid, hitLimit, err = traceSyscalls(res.pid, &res.ws,
+		h.cfg.maxSyscalls, h.snapshot != nil, traps, wd)
+	timedOut := wd.stop()
+	// Servers killed once they stopped replying finished normally.
+	ended := false
+	if exchange != nil {
+		var exErr error
+		ended, exErr = exchange.stop()
+		if exErr != nil {
+			log.Printf("Harness with id %d failed to deliver input: %s\n",
+				h.id, exErr.Error())
+		}
+	}
+	if err != nil {
+		killProgram(res.pid)
+		if h.server != nil {
+			h.server.reap()
+		}
+		h.dropSnapshot()
+		return res, err
+	}
+	// Snapshots are stopped on exit, and kept for the next run.
+	kept := h.snapshot != nil && !timedOut && res.ws.Stopped()
+	if kept && !hitLimit && res.ws.StopSignal() == syscall.SIGTRAP|0x80 {
+		res.ws, err = exitStatus(res.pid)
+		if err != nil {
+			h.dropSnapshot()
+			return res, fmt.Errorf("failed to read exit status: %s", err.Error())
+		}
+	}
+
+	// Hangs are killed by the harness and are not crashes.
+	res.hung = hitLimit || timedOut
+	res.crash, res.crashed = classifyCrash(res.ws)
+	res.crashed = res.crashed && !res.hung && !(ended && res.ws.Signaled())
+
+	// Inspect crashed programs while they are still stopped.
+	if res.crashed && res.ws.Stopped() {
+		err = res.crash.collectStack(res.crashPid, h.cfg.stackDepth)
+		if err != nil {
+			log.Printf("Harness with id %d failed to read crash stack: %s\n",
+				h.id, err.Error())
+		}
+		res.crash.snapshot, err = takeSnapshot(res.crashPid)
+		if err != nil {
+			log.Printf("Harness with id %d failed to take crash snapshot: %s\n",
+				h.id, err.Error())
+		}
+	}
+	if res.crashed {
+		res.crash.triage = triageCrash(&res.crash)
+	}
+
+	// Programs stopped at a fatal signal or the syscall limit are
+	// still alive, as may be tasks left behind by the program. Snapshots
+	// which ended otherwise are lost and taken again on the next run, as
+	// are those which can not be rewound.
+	if !kept || h.freshSnapshots {
+		killProgram(res.pid)
+		h.dropSnapshot()
+	}
+	if h.server != nil {
+		err = h.server.reap()
+		if err != nil {
+			return res, fmt.Errorf("lost fork server: %s", err.Error())
+		}
+	}
+	countExec()
+	if h.shm != nil {
+		res.trace.edges = h.shm.read()
+	}
+
+	res.crash.output = h.capture.read()
+
+	// Sanitizers report errors on stderr and usually exit with an
+	// error code rather than crashing.
+	if !res.hung {
+		if rep, ok := parseSanitizerReport(res.crash.output.stderr); ok {
+			if !res.crashed {
+				res.crashPid = res.pid
+			}
+			rep.applyTo(&res.crash, h.cfg.stackDepth)
+			res.crashed = true
+		}
+	}
+	return res, nil
+}
+
+/*
+ * Rewinds the snapshot to run input, taking the snapshot first if there
+ * is none. The snapshot is dropped if it can not be rewound, and once
+ * the program reaches state it can not be rewound over, a new snapshot
+ * is taken for every input instead.
+ * Returns the pid of the program, ready for traceSyscalls.
+ */
+func (h *harnessState) runSnapshot(input []byte) (int, error) {
+	var err error
+	if h.snapshot == nil {
+		h.snapshot, err = startSnapshotServer(h.cfg, h.inputFile, h.capture,
+			h.inputFile.Name())
 		if err != nil {
-			log.Fatalf("Harness with id %d failed to write to program: %s\n",
+			return 0, fmt.Errorf("failed to take snapshot: %s", err.Error())
+		}
+	}
+	pid, err := h.snapshot.run(h.inputFile, input)
+	if _, unrestorable := err.(*unrestorableError); unrestorable && !h.freshSnapshots {
+		log.Printf("Harness with id %d can not rewind snapshots, taking one for every input: %s\n",
+			h.id, err.Error())
+		h.freshSnapshots = true
+		h.dropSnapshot()
+		return h.runSnapshot(input)
+	}
+	if err != nil {
+		h.dropSnapshot()
+		return 0, fmt.Errorf("failed to restore snapshot: %s", err.Error())
+	}
+	return pid, nil
+}
+
+/*
+ * Kills the program the snapshot is held in, if any.
+ */
+func (h *harnessState) dropSnapshot() {
+	if h.snapshot != nil {
+		h.snapshot.stop()
+		h.snapshot = nil
+	}
+}
+
+/*
+ * Saves the findings of a run of inputCase.
+ */
+func (h *harnessState) report(inputCase TestCase, res execResult) {
+	id, crash := h.id, res.crash
+	var err error
+
+	if res.hung {
+		saved, err := h.store.addHang(inputCase, res.trace)
+		if err != nil {
+			log.Printf("Harness with id %d failed to save hang: %s\n",
 				id, err.Error())
+		} else if saved {
+			log.Printf("Harness with id %d hung process with pid %d\n",
+				id, res.pid)
 		}
+		return
+	}
+	if h.feedback.addRun(res.trace) {
+		// This channel is currently not used, leading to deadlock
+		// if given input here.
+		//h.interestCases <- inputCase
+	}
 
-		// Process may need pipe closed to continue.
-		err = procStdin.Close()
+	// Report crashes and limits reached, which programs may handle and
+	// exit cleanly after, and ignore other exit causes.
+	kind, limited := resourceLimitHit(crash, res.crashed, res.trace, h.cfg.rlimits)
+	if limited && !res.crashed {
+		crash.class = "resource limit: " + kind
+		saved, err := h.store.addLimit(inputCase, crash)
+		if saved {
+			log.Printf("Harness with id %d hit a limit in process with pid %d: %s\n",
+				id, res.pid, crash.class)
+		}
+		if err != nil {
+			log.Printf("Harness with id %d failed to save limit finding: %s\n",
+				id, err.Error())
+		}
+	}
+	if res.crashed {
+		var saved bool
+		if limited {
+			crash.class = "resource limit: " + kind
+			saved, err = h.store.addLimit(inputCase, crash)
+		} else {
+			saved, err = h.store.addCrash(inputCase, crash)
+		}
+		if saved && crash.signal != 0 {
+			log.Printf("Harness with id %d crashed process with pid %d: %s (%s)\n",
+				id, res.crashPid, crash.class, syscall.SignalName(crash.signal))
+		} else if saved {
+			log.Printf("Harness with id %d crashed process with pid %d: %s\n",
+				id, res.crashPid, crash.class)
+		}
+		// Log the crashing input on any file operation failure.
 		if err != nil {
-			log.Printf("Harness with id %d failed to manually close stdin pipe.\n",
-				id)
+			log.Printf("Harness with id %d failed to save crash: %s\n",
+				id, err.Error())
+			log.Println("Crashing input:")
+			log.Println(string(inputCase.input))
 		}
+	}
 
-		// Trace execution and report back interesting cases.
-		curExecTrace := traceSyscalls(procPid, &ws)
-		runtime.UnlockOSThread()
-		if isUniqueTrace(curExecTrace, uniqueTraces) {
-			uniqueTraces = append(uniqueTraces, curExecTrace)
-			// This channel is currently not used, leading to deadlock
-			// if given input here.
-			//interestCases <- inputCase
+	// Runs which exited cleanly may still be flagged by an oracle.
+	if !res.crashed && !limited {
+		desc, flagged := checkOracles(h.cfg, res.ws, crash.output)
+		if flagged {
+			saved, err := h.store.addOracle(inputCase, desc, crash.output)
+			if saved {
+				log.Printf("Harness with id %d flagged process with pid %d: %s\n",
+					id, res.pid, desc)
+			}
+			if err != nil {
+				log.Printf("Harness with id %d failed to save oracle finding: %s\n",
+					id, err.Error())
+			}
 		}
+	}
+
+	if res.crashed && h.cfg.stopOnCrash {
+		exitFuzzer(0)
+	}
+}
 
-		// Report segfaults and ignore other exit causes.
-		if ws.StopSignal() == syscall.SIGSEGV {
-			log.Printf("Harness with id %d crashed process with pid %d\n",
-				id, procPid)
-			crashReport(inputCase)
+/*
+ * Starts the program in cfg under ptrace in its own process group and
+ * feeds it input, through inputFile when it is not nil and otherwise on
+ * stdin. The program's output is written to capture.
+ * Must be called from a locked OS thread.
+ * Returns the pid of the program, stopped and ready for traceSyscalls.
+ */
+func startProgram(cfg *harnessConfig, inputFile *os.File, capture *outputCapture,
+	input []byte) (int, error) {
+	var err error
+	var procStdin io.WriteCloser
+	var procCmd *exec.Cmd
+	if inputFile != nil {
+		err = writeInputFile(inputFile, input)
+		if err != nil {
+			return 0, fmt.Errorf("failed to write input file: %s", err.Error())
 		}
+		procCmd = targetCommand(cfg, cfg.targetArgs(inputFile.Name()))
+	} else {
+		procCmd = targetCommand(cfg, cfg.args)
+		procStdin, err = procCmd.StdinPipe()
+		if err != nil {
+			return 0, fmt.Errorf("failed to connect stdin pipe: %s", err.Error())
+		}
+	}
+	procCmd.Env = cfg.env
+	procCmd.Dir = cfg.dir
+	procCmd.Stdout = capture.stdout.w
+	procCmd.Stderr = capture.stderr.w
+
+	err = procCmd.Start()
+	if err != nil {
+		return 0, err
+	}
+	procPid := procCmd.Process.Pid
+	trackProgram(procPid)
+	err = prepareProgram(cfg, procPid, capture, procStdin, input)
+	if err != nil {
+		if procStdin != nil {
+			procStdin.Close()
+		}
+		killProgram(procPid)
+		return 0, err
 	}
+	return procPid, nil
 }
 
 /*
- * Creates a "bad.txt" file in the current directory containing
- * the input inside crashCase
+ * Prepares a program started by startProgram for tracing: sets
+ * traceOptions and its resource limits, and writes input to procStdin
+ * when it is not nil.
  */
-func crashReport(crashCase TestCase) {
-	var doExit bool = true
+func prepareProgram(cfg *harnessConfig, procPid int, capture *outputCapture,
+	procStdin io.WriteCloser, input []byte) error {
+	// Child process recieves signal on startup.
+	var ws syscall.WaitStatus
+	_, err := syscall.Wait4(procPid, &ws, syscall.WALL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to wait: %s", err.Error())
+	}
+	if ws.Exited() {
+		// Only happens when the sandbox could not be set up.
+		out := capture.read()
+		return fmt.Errorf("program exited before it was traced: %s", out.stderr)
+	}
 
-	f, err := os.OpenFile("bad.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	// Log the crashing input on any file operation failure.
+	err = syscall.PtraceSetOptions(procPid, traceOptions)
 	if err != nil {
-		log.Println("Failed to create crash output file. Crashing output:")
-		log.Println(string(crashCase.input))
-		return
+		return fmt.Errorf("failed to set ptrace options: %s", err.Error())
+	}
+
+	err = applyRlimits(procPid, cfg.rlimits)
+	if err != nil {
+		return err
 	}
 
-	nWritten, err := f.Write(crashCase.input)
-	// Log crash output on failed or incomplete writes.
-	if err != nil || nWritten != len(crashCase.input) {
-		log.Println("Failed to write output to crash file. Crashing output:")
-		log.Println(string(crashCase.input))
-		// Continue execution to try hit another crash.
-		doExit = false
+	if procStdin != nil {
+		_, err = procStdin.Write(input)
+		if err != nil {
+			return fmt.Errorf("failed to write to program: %s", err.Error())
+		}
+
+		// Process may need pipe closed to continue.
+		err = procStdin.Close()
+		if err != nil {
+			log.Println("Failed to manually close stdin pipe.")
+		}
 	}
+	return nil
+}
 
-	err = f.Close()
+/*
+ * Replaces the contents of f with input.
+ */
+func writeInputFile(f *os.File, input []byte) error {
+	err := f.Truncate(0)
 	if err != nil {
-		log.Fatal("crashReport failed to close the file")
+		return err
 	}
+	_, err = f.WriteAt(input, 0)
+	return err
+}
 
-	// Stop execution on first bad output hit unless there was an error
-	// in file generation.
-	if doExit {
-		os.Exit(0)
+/*
+ * Kills every task of the traced program started as pid and reaps them.
+ * Must be called from the thread tracing the program.
+ */
+func killProgram(pid int) {
+	defer untrackProgram(pid)
+	tasks := trackedTasks(pid)
+	err := reapKilled(tasks, tasks.list())
+	if err != nil {
+		log.Printf("Failed to reap program %d: %s\n", pid, err.Error())
+	}
+}
+
+/*
+ * Kills the tasks tids of a traced program and reaps them, removing
+ * them from tasks. Killed tasks still stop on their way out, see
+ * traceOptions, and are resumed so they can exit. Tasks created while
+ * the program is being killed stop before they run, and are killed as
+ * well.
+ * Must be called from the thread tracing the program.
+ */
+func reapKilled(tasks *programTasks, tids []int) error {
+	pending := map[int]bool{}
+	for _, tid := range tids {
+		// Threads replaced by an exec are gone without an exit status.
+		if syscall.Kill(tid, syscall.SIGKILL) == syscall.ESRCH {
+			tasks.remove(tid)
+			continue
+		}
+		pending[tid] = true
+	}
+	var ws syscall.WaitStatus
+	for len(pending) > 0 {
+		tid, err := syscall.Wait4(-1, &ws, syscall.WALL|syscall.WNOTHREAD, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		// Nothing is left to wait for.
+		if err == syscall.ECHILD {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ws.Stopped() {
+			if !tasks.has(tid) {
+				tasks.add(tid)
+				pending[tid] = true
+				syscall.Kill(tid, syscall.SIGKILL)
+			}
+			syscall.PtraceCont(tid, 0)
+			continue
+		}
+		tasks.remove(tid)
+		delete(pending, tid)
 	}
+	return nil
 }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"plugin"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+/*
+ * This file contains the in-process mode, where a Go function loaded
+ * from a plugin is called with inputs from the mutators instead of
+ * running a program under ptrace. Panics are recovered with the stack
+ * they were raised on and saved with the same finding store as program
+ * crashes, and a call running past its timeout is saved as a hang.
+ */
+
+/*
+ * Function fuzzed in-process. It should panic on bugs.
+ */
+type fuzzTarget func([]byte)
+
+/*
+ * Symbol looked up in a plugin when none is given.
+ */
+const defaultPluginSymbol = "Fuzz"
+
+/*
+ * A panic recovered from the target.
+ * message: value the target panicked with as text, the error message
+ *          for errors.
+ * stack: stack trace of the panicking goroutine, as printed by
+ *        debug.Stack.
+ */
+type targetPanic struct {
+	message string
+	stack   []byte
+}
+
+/*
+ * Loads a fuzz target from a Go plugin built with -buildmode=plugin,
+ * which must export symbol as a func([]byte). The plugin has to be
+ * built with the same Go version and dependencies as the fuzzer.
+ */
+func loadPluginTarget(path, symbol string) (fuzzTarget, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(symbol)
+	if err != nil {
+		return nil, err
+	}
+	target, ok := sym.(func([]byte))
+	if !ok {
+		return nil, fmt.Errorf("%s is a %T, not a func([]byte)", symbol, sym)
+	}
+	return target, nil
+}
+
+/*
+ * Calls target with inputs from the inputCases channel one at a time,
+ * as targets may not be safe to call concurrently. Panics are saved in
+ * store as crashes, bucketed by the function frames of the panicking
+ * stack. A call running past cfg.timeout cannot be stopped from outside
+ * its goroutine, so it is saved as a hang, bucketed by the frames it
+ * was stuck in, and the fuzzer stops. Fatal runtime errors, e.g.
+ * concurrent map writes or running out of stack, cannot be recovered
+ * and end the fuzzer.
+ * Returns once inputCases is closed.
+ */
+func inProcessHarness(id int, target fuzzTarget, cfg *harnessConfig,
+	store *findingStore, inputCases <-chan TestCase) {
+
+	for inputCase := range inputCases {
+		started := make(chan string, 1)
+		done := make(chan *targetPanic, 1)
+		go callTarget(target, inputCase.input, started, done)
+		goroutine := <-started
+
+		var p *targetPanic
+		if cfg.timeout > 0 {
+			timer := time.NewTimer(cfg.timeout)
+			select {
+			case p = <-done:
+				timer.Stop()
+			case <-timer.C:
+				reportInProcessHang(id, cfg, store, inputCase, goroutine)
+				exitFuzzer(0)
+			}
+		} else {
+			p = <-done
+		}
+		countExec()
+		if p == nil {
+			continue
+		}
+
+		crash := panicCrash(*p, cfg.stackDepth)
+		saved, err := store.addCrash(inputCase, crash)
+		if saved {
+			log.Printf("Harness with id %d panicked target: %s\n", id, crash.class)
+		}
+		if err != nil {
+			log.Printf("Harness with id %d failed to save crash: %s\n",
+				id, err.Error())
+			log.Println("Crashing input:")
+			log.Println(string(inputCase.input))
+		}
+		if cfg.stopOnCrash {
+			exitFuzzer(0)
+		}
+	}
+}
+
+/*
+ * Calls target with a copy of input, as it may keep or modify it. The
+ * id of the calling goroutine is sent on started before the call, and
+ * the recovered panic, or nil if the target returned, on done after it.
+ */
+func callTarget(target fuzzTarget, input []byte, started chan<- string,
+	done chan<- *targetPanic) {
+
+	started <- goroutineID()
+	var p *targetPanic
+	defer func() {
+		// Recovered in the deferred call so the stack still holds the
+		// panicking frames.
+		if r := recover(); r != nil {
+			msg := fmt.Sprint(r)
+			if err, ok := r.(error); ok {
+				msg = err.Error()
+			}
+			p = &targetPanic{message: msg, stack: debug.Stack()}
+		}
+		done <- p
+	}()
+	target(append([]byte{}, input...))
+}
+
+/*
+ * Returns the id of the calling goroutine, as printed in the header of
+ * its stack trace, e.g. "goroutine 18 [running]:".
+ */
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return ""
+	}
+	return string(fields[1])
+}
+
+/*
+ * Returns the stack trace of the goroutine with the given id, or nil if
+ * it is not running.
+ */
+func goroutineStack(goroutine string) []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	header := []byte("goroutine " + goroutine + " [")
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return stack
+		}
+	}
+	return nil
+}
+
+/*
+ * Saves an input which hung the target in the goroutine with the given
+ * id, bucketed by the frames of the call which were running.
+ */
+func reportInProcessHang(id int, cfg *harnessConfig, store *findingStore,
+	hangCase TestCase, goroutine string) {
+
+	stack := goroutineStack(goroutine)
+	frames := targetFrames(stack)
+	if len(frames) > cfg.stackDepth {
+		frames = frames[:cfg.stackDepth]
+	}
+	hang := crashInfo{
+		class:     fmt.Sprintf("hang: ran for longer than %s", cfg.timeout),
+		frames:    frames,
+		signature: stackSignature(0, append([]string{"hang"}, frames...)),
+		output:    runOutput{stderr: stack},
+	}
+	_, err := store.addInProcessHang(hangCase, hang)
+	if err != nil {
+		log.Printf("Harness with id %d failed to save hang: %s\n", id, err.Error())
+		return
+	}
+	log.Printf("Harness with id %d hung target, stopping\n", id)
+}
+
+/*
+ * Builds the crash details of a recovered panic, keeping up to maxFrames
+ * frames of the stack below the panic for the signature.
+ */
+func panicCrash(p targetPanic, maxFrames int) crashInfo {
+	frames := targetFrames(p.stack)
+	if len(frames) > maxFrames {
+		frames = frames[:maxFrames]
+	}
+	// Messages often hold values from the input, e.g. slice indices,
+	// so only the frames go into the signature.
+	return crashInfo{
+		class:     "panic: " + strings.SplitN(p.message, "\n", 2)[0],
+		frames:    frames,
+		signature: stackSignature(0, append([]string{"panic"}, frames...)),
+		output: runOutput{
+			stderr: []byte(fmt.Sprintf("panic: %s\n\n%s", p.message, p.stack)),
+		},
+	}
+}
+
+/*
+ * Name of callTarget as printed in stack traces, above which frames
+ * belong to the target rather than the harness.
+ */
+var callTargetName string
+
+func init() {
+	callTargetName = runtime.FuncForPC(reflect.ValueOf(callTarget).Pointer()).Name()
+}
+
+/*
+ * Parses the frames of the target in a goroutine stack trace, as
+ * printed by debug.Stack, into "function file:line" strings, innermost
+ * first. Frames above a panic call belong to the recovery, so only
+ * those below it are kept.
+ */
+func targetFrames(stack []byte) []string {
+	// A trace is a header line, then two lines per frame: the function
+	// with its arguments, and its indented file:line and pc offset.
+	lines := strings.Split(strings.TrimRight(string(stack), "\n"), "\n")
+	var frames []string
+	for i := 1; i+1 < len(lines); i += 2 {
+		fn := lines[i]
+		if paren := strings.LastIndex(fn, "("); paren > 0 {
+			fn = fn[:paren]
+		}
+		// Runtime frames below the panic raise runtime errors such as
+		// nil dereferences, and those of a hung call park it.
+		if fn == "panic" {
+			frames = frames[:0]
+			continue
+		}
+		if strings.HasPrefix(fn, "runtime.") {
+			continue
+		}
+		if fn == callTargetName {
+			break
+		}
+		pos := strings.Fields(strings.TrimSpace(lines[i+1]))
+		if len(pos) > 0 {
+			fn += " " + pos[0]
+		}
+		frames = append(frames, fn)
+	}
+	return frames
+}
@@ -1,36 +1,235 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
- * Accepts an executable file and an input file to run it with.
+ * Accepts an executable file and an input file to run it with, or an
+ * input file to run a Go plugin's fuzz target with in-process.
  */
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Usage:", os.Args[0], "<binary>", "<input file>")
+	if os.Args[0] == sandboxInitArg {
+		sandboxInit(os.Args[1:])
+	}
+
+	outDir := flag.String("o", "findings", "directory to save findings in")
+	timeout := flag.Duration("timeout", time.Second,
+		"wall clock limit for each run, 0 to disable")
+	maxSyscalls := flag.Int("max-syscalls", 100000,
+		"syscall limit for each run, 0 to disable")
+	stopOnCrash := flag.Bool("stop-on-crash", false,
+		"exit after the first crash is found")
+	stackDepth := flag.Int("stack-depth", 5,
+		"number of stack frames used to deduplicate crashes")
+	var setEnv, unsetEnv stringList
+	flag.Var(&setEnv, "env", "set KEY=value in the binary's environment, repeatable")
+	flag.Var(&unsetEnv, "unset-env", "remove KEY from the binary's environment, repeatable")
+	clearEnv := flag.Bool("clear-env", false,
+		"start the binary with an empty environment")
+	dir := flag.String("dir", "", "working directory of the binary")
+	var rlimitSpecs stringList
+	flag.Var(&rlimitSpecs, "rlimit", "resource limit for the binary as name=value, "+
+		"where name is as, fsize, core, nofile or cpu and value may end in K, M or G, "+
+		"repeatable (default core=0)")
+	outputLimit := flag.Int("output-limit", 64*1024,
+		"bytes of stdout and stderr kept from each run")
+	var outputOracleExprs, exitOracleCodes stringList
+	flag.Var(&outputOracleExprs, "output-oracle",
+		"flag runs whose stdout or stderr matches this regexp, repeatable")
+	flag.Var(&exitOracleCodes, "exit-oracle",
+		"flag runs which exit with this code, repeatable")
+	forkServer := flag.Bool("forkserver", false,
+		"start the binary once and fork a copy of it for every input")
+	entry := flag.String("entry", "main",
+		"function or 0x address the fork server stops the binary at")
+	sandbox := flag.String("sandbox", "",
+		"run the binary in namespaces with no network and a read-only filesystem, "+
+			"either "+sandboxReadOnly+", or "+sandboxTmpfs+" to give it throwaway "+
+			"writable temporary directories")
+	netProto := flag.String("net", "",
+		"send inputs to the binary as a "+netTCP+" or "+netUDP+" server instead of on stdin")
+	netPort := flag.Int("port", 0, "loopback port the server listens on")
+	netReplyTimeout := flag.Duration("reply-timeout", 100*time.Millisecond,
+		"time without a reply from the server after which a run ends")
+	snapshotPoint := flag.String("snapshot", "",
+		"function or 0x address to snapshot the binary at and run every input from")
+	snapshotBuffer := flag.String("snapshot-buffer", "",
+		"function or 0x address of a buffer to write inputs to in snapshot mode "+
+			"instead of passing them on stdin")
+	snapshotBufferSize := flag.Int("snapshot-buffer-size", 0,
+		"size of the snapshot buffer (default the size of its symbol)")
+	coverage := flag.String("coverage", coverageTrace,
+		"how runs are told apart as new behaviour, "+coverageTrace+" for exact syscall "+
+			"traces, "+coverageBitmap+" for a bitmap of syscall transitions, "+
+			coverageBlocks+" for the binary's basic blocks, found with breakpoints, or "+
+			coverageShm+" for the edges a binary instrumented as for AFL counts in "+
+			"the shared memory named by "+shmEnvVar)
+	pluginPath := flag.String("plugin", "",
+		"fuzz a func([]byte) exported by this Go plugin in-process instead of a binary")
+	pluginSymbol := flag.String("symbol", defaultPluginSymbol,
+		"name of the function the plugin exports")
+	statsInterval := flag.Duration("stats", 10*time.Second,
+		"interval between statistics reports, 0 to disable")
+	flag.Usage = func() {
+		fmt.Println("Usage:", os.Args[0], "[options]", "<binary>", "<input file>",
+			"[binary args]")
+		fmt.Println("Use", inputPlaceholder, "in the binary args to pass inputs",
+			"as a file path instead of on stdin.")
+		fmt.Println("Options must come before <binary>.")
+		fmt.Println("Usage:", os.Args[0], "[options]", "-plugin", "<plugin>", "<input file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if (*pluginPath == "" && flag.NArg() < 2) || (*pluginPath != "" && flag.NArg() != 1) {
+		flag.Usage()
+		return
+	}
+	handleSignals()
+	var target fuzzTarget
+	var cmd, inputFile string
+	var args []string
+	var err error
+	if *pluginPath != "" {
+		if *forkServer || *sandbox != "" || *netProto != "" || *snapshotPoint != "" ||
+			*coverage != coverageTrace {
+			fmt.Println("Invalid plugin: -forkserver, -sandbox, -net, -snapshot and " +
+				"-coverage only apply to binaries")
+			return
+		}
+		target, err = loadPluginTarget(*pluginPath, *pluginSymbol)
+		if err != nil {
+			fmt.Println("Unable to load plugin:", err)
+			return
+		}
+		inputFile = flag.Arg(0)
+	} else {
+		cmd, err = resolveBinary(flag.Arg(0))
+		if err != nil {
+			fmt.Println("Unable to find binary:", err)
+			return
+		}
+		inputFile, args = flag.Arg(1), flag.Args()[2:]
+	}
+	rlimits, err := buildRlimits(rlimitSpecs)
+	if err != nil {
+		fmt.Println("Invalid resource limit:", err)
+		return
+	}
+	if *outputLimit < 0 {
+		fmt.Println("Invalid output limit:", *outputLimit)
+		return
+	}
+	outputOracles, err := compileOracles(outputOracleExprs)
+	if err != nil {
+		fmt.Println("Invalid output oracle:", err)
+		return
+	}
+	err = checkSandboxMode(*sandbox)
+	if err != nil {
+		fmt.Println("Invalid sandbox:", err)
+		return
+	}
+	var sandboxDir string
+	if *sandbox != "" {
+		sandboxDir, err = ioutil.TempDir("", "fuzzer-sandbox-")
+		if err != nil {
+			fmt.Println("Unable to create sandbox directory:", err)
+			return
+		}
+		trackTempPath(sandboxDir)
+		defer removeTempPath(sandboxDir)
+	}
+	err = checkCoverageMode(*coverage, *sandbox)
+	if err != nil {
+		fmt.Println("Invalid coverage:", err)
+		return
+	}
+	err = checkNetMode(*netProto, *netPort, *sandbox)
+	if err != nil {
+		fmt.Println("Invalid network mode:", err)
 		return
 	}
+	var exitOracles []int
+	for _, code := range exitOracleCodes {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			fmt.Println("Invalid exit oracle:", code)
+			return
+		}
+		exitOracles = append(exitOracles, n)
+	}
+	cfg := &harnessConfig{
+		cmd:         cmd,
+		args:        args,
+		env:         buildEnv(*clearEnv, unsetEnv, setEnv),
+		dir:         *dir,
+		rlimits:     rlimits,
+		timeout:     *timeout,
+		maxSyscalls: *maxSyscalls,
+		stopOnCrash: *stopOnCrash,
+		stackDepth:  *stackDepth,
+
+		outputLimit:   *outputLimit,
+		outputOracles: outputOracles,
+		exitOracles:   exitOracles,
+
+		forkServer:      *forkServer,
+		forkServerEntry: *entry,
+
+		sandbox:    *sandbox,
+		sandboxDir: sandboxDir,
+
+		netProto:        *netProto,
+		netPort:         *netPort,
+		netReplyTimeout: *netReplyTimeout,
+
+		snapshotPoint:      *snapshotPoint,
+		snapshotBuffer:     *snapshotBuffer,
+		snapshotBufferSize: *snapshotBufferSize,
+	}
+	err = checkSnapshotMode(cfg)
+	if err != nil {
+		fmt.Println("Invalid snapshot:", err)
+		return
+	}
+
 	// create channels for mutator and harness
 	mutatorToHarness := make(chan TestCase)
 	harnessToInteresting := make(chan TestCase)
 
-	input, err := ioutil.ReadFile(os.Args[2])
+	input, err := ioutil.ReadFile(inputFile)
 	if err != nil {
 		fmt.Println("Unable to read input file")
 		return
 	}
 
-	if isValidCSV(os.Args[2]) {
-		generatorToHarness := make(chan TestCase)
-		go generateCSVs(generatorToHarness, os.Args[2])
-		go harness(5, "./"+os.Args[1], generatorToHarness, harnessToInteresting)
+	store, err := newFindingStore(*outDir)
+	if err != nil {
+		fmt.Println("Unable to create output directory:", err)
+		return
 	}
 
+	// No syscalls are traced in-process, so plugins have no feedback.
+	var feedback *feedbackManager
+	if target == nil {
+		feedback, err = newFeedbackManager(*coverage, cmd)
+		if err != nil {
+			fmt.Println("Unable to set up coverage:", err)
+			return
+		}
+	}
+	if *statsInterval > 0 {
+		go reportStats(*statsInterval, feedback)
+	}
 
 	// create mutator threads
 	for i := 0; i < 4; i++ {
@@ -43,11 +242,43 @@ func main() {
 			}
 		}(i)
 	}
+
+	// Go functions are called one input at a time, as the fuzz target
+	// may not be safe to call concurrently.
+	if target != nil {
+		inProcessHarness(0, target, cfg, store, mutatorToHarness)
+		return
+	}
+
+	// Servers sharing the fuzzer's network namespace would fight over
+	// the port, so only one harness runs them unless they are sandboxed.
+	single := cfg.netProto != "" && cfg.sandbox == ""
+
+	if isValidCSV(inputFile) && !single {
+		generatorToHarness := make(chan TestCase)
+		go generateCSVs(generatorToHarness, inputFile)
+		go harness(5, cfg, store, feedback, generatorToHarness, harnessToInteresting)
+	}
+
 	// create harness threads
-	for i := 0; i < 4; i++ {
-		go harness(i, "./"+os.Args[1], mutatorToHarness, harnessToInteresting)
+	for i := 0; i < 4 && !single; i++ {
+		go harness(i, cfg, store, feedback, mutatorToHarness, harnessToInteresting)
 
 	}
 
-	harness(4, "./"+os.Args[1], mutatorToHarness, harnessToInteresting)
+	harness(4, cfg, store, feedback, mutatorToHarness, harnessToInteresting)
+}
+
+/*
+ * Command line flag which may be given more than once.
+ */
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
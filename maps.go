@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This file contains helpers for reading the memory layout of a
+ * traced program from /proc/pid/maps.
+ */
+
+/*
+ * A single line of /proc/pid/maps.
+ * start, end: address range of the mapping.
+ * perms: permission string such as "r-xp".
+ * offset: offset of the mapping into the mapped file.
+ * path: mapped file or pseudo path, empty for anonymous mappings.
+ */
+type memMapping struct {
+	start  uint64
+	end    uint64
+	perms  string
+	offset uint64
+	path   string
+}
+
+/*
+ * Reads the memory mappings of the process with the given pid.
+ * Returns the mappings in address order.
+ */
+func readMaps(pid int) ([]memMapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var maps []memMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m, err := parseMapping(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+	return maps, scanner.Err()
+}
+
+/*
+ * Parses one line of /proc/pid/maps, e.g.
+ * 	55d0c4a00000-55d0c4a01000 r-xp 00001000 08:01 1234  /bin/prog
+ */
+func parseMapping(line string) (memMapping, error) {
+	var m memMapping
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return m, fmt.Errorf("malformed maps line: %q", line)
+	}
+
+	addrs := strings.SplitN(fields[0], "-", 2)
+	if len(addrs) != 2 {
+		return m, fmt.Errorf("malformed maps range: %q", fields[0])
+	}
+	var err error
+	if m.start, err = strconv.ParseUint(addrs[0], 16, 64); err != nil {
+		return m, err
+	}
+	if m.end, err = strconv.ParseUint(addrs[1], 16, 64); err != nil {
+		return m, err
+	}
+	if m.offset, err = strconv.ParseUint(fields[2], 16, 64); err != nil {
+		return m, err
+	}
+	m.perms = fields[1]
+	if len(fields) > 5 {
+		m.path = strings.Join(fields[5:], " ")
+	}
+	return m, nil
+}
+
+/*
+ * Finds the mapping containing addr.
+ * Returns the mapping and whether one was found.
+ */
+func findMapping(maps []memMapping, addr uint64) (memMapping, bool) {
+	for _, m := range maps {
+		if addr >= m.start && addr < m.end {
+			return m, true
+		}
+	}
+	return memMapping{}, false
+}
+
+/*
+ * Returns the load address of the module mapped at path: the lowest
+ * address of any of its mappings.
+ */
+func moduleBase(maps []memMapping, path string) uint64 {
+	var base uint64
+	found := false
+	for _, m := range maps {
+		if m.path == path && (!found || m.start < base) {
+			base = m.start
+			found = true
+		}
+	}
+	return base
+}
+
+/*
+ * Describes addr as a module and offset into that module, which stays
+ * the same across runs regardless of ASLR.
+ * Addresses outside of file mappings are described only by the kind of
+ * mapping they are in, as their exact value changes between runs.
+ */
+func symbolizeAddr(maps []memMapping, addr uint64) string {
+	m, ok := findMapping(maps, addr)
+	switch {
+	case !ok:
+		return "[unmapped]"
+	case m.path == "":
+		return "[anon]"
+	case strings.HasPrefix(m.path, "["):
+		return m.path
+	}
+	return fmt.Sprintf("%s+0x%x", m.path, addr-moduleBase(maps, m.path))
+}
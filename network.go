@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * This file contains the network server mode, where inputs are sent to
+ * the program over a loopback socket instead of on stdin. A server is
+ * started for every input, or forked off the fork server, and the run
+ * ends once the server stops replying.
+ */
+
+/*
+ * Protocols servers can be fuzzed over.
+ */
+const (
+	netTCP = "tcp"
+	netUDP = "udp"
+)
+
+/*
+ * Interval at which the server is checked for a listening socket.
+ */
+const listenPollInterval = 5 * time.Millisecond
+
+/*
+ * Time the server is given to finish with an input after its last
+ * reply, as it may still crash on it, before the run is ended.
+ */
+const netGracePeriod = 10 * time.Millisecond
+
+/*
+ * Checks the protocol and port of the network mode, an empty protocol
+ * disabling it.
+ * Sandboxed servers are reached by joining their network namespace,
+ * which the kernel only allows with CAP_SYS_ADMIN.
+ */
+func checkNetMode(proto string, port int, sandbox string) error {
+	switch proto {
+	case "":
+		return nil
+	case netTCP, netUDP:
+	default:
+		return fmt.Errorf("unknown protocol %q, expected %s or %s", proto, netTCP, netUDP)
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d is out of range", port)
+	}
+	if sandbox != "" && !hasCapSysAdmin() {
+		return fmt.Errorf("fuzzing sandboxed servers requires CAP_SYS_ADMIN")
+	}
+	return nil
+}
+
+/*
+ * Checks whether the fuzzer has CAP_SYS_ADMIN in its user namespace.
+ */
+func hasCapSysAdmin() bool {
+	hdr := syscall.CapUserHeader{Version: syscall.LINUX_CAPABILITY_VERSION_3}
+	var data [2]syscall.CapUserData
+	err := syscall.Capget(&hdr, &data[0])
+	if err != nil {
+		return false
+	}
+	return data[0].Effective&(1<<syscall.CAP_SYS_ADMIN) != 0
+}
+
+/*
+ * Delivery of one input to a server program.
+ * conn: connection to the server, once made.
+ * stopped: closed once the harness no longer lets the exchange kill
+ *          the program.
+ * ended: whether the exchange ended the run by killing the program.
+ * err: error which kept the exchange from delivering the input.
+ * done: closed once the exchange has finished.
+ */
+type netExchange struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	stopped chan struct{}
+	ended   bool
+	err     error
+	done    chan struct{}
+}
+
+/*
+ * Starts sending input to the server started as pid once it
+ * listens on the port in cfg. The server is killed once it has not
+ * replied for cfg.netReplyTimeout.
+ */
+func startExchange(cfg *harnessConfig, pid int, input []byte) *netExchange {
+	e := &netExchange{stopped: make(chan struct{}), done: make(chan struct{})}
+	go e.run(cfg, pid, input)
+	return e
+}
+
+func (e *netExchange) run(cfg *harnessConfig, pid int, input []byte) {
+	defer close(e.done)
+
+	// A sandboxed server has a network namespace of its own, which
+	// this thread joins. The thread is thrown away when the goroutine
+	// exits locked.
+	if cfg.sandbox != "" {
+		runtime.LockOSThread()
+		err := joinNetNamespace(pid)
+		if err != nil {
+			e.err = fmt.Errorf("failed to join network namespace: %s", err.Error())
+			return
+		}
+	}
+
+	var host string
+	for {
+		var err error
+		host, err = isListening(cfg.netProto, cfg.netPort)
+		if err != nil {
+			e.err = err
+			return
+		}
+		if e.isStopped() {
+			return
+		}
+		if host != "" {
+			break
+		}
+		time.Sleep(listenPollInterval)
+	}
+
+	conn, err := net.Dial(cfg.netProto, net.JoinHostPort(host, strconv.Itoa(cfg.netPort)))
+	if err != nil {
+		e.err = fmt.Errorf("failed to connect to server: %s", err.Error())
+		e.end(pid)
+		return
+	}
+	e.mu.Lock()
+	if e.isStopped() {
+		e.mu.Unlock()
+		conn.Close()
+		return
+	}
+	e.conn = conn
+	e.mu.Unlock()
+	defer conn.Close()
+
+	_, err = conn.Write(input)
+	if err != nil {
+		e.err = fmt.Errorf("failed to send input: %s", err.Error())
+		e.end(pid)
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+
+	// Read replies until the server closes the connection or goes quiet.
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(cfg.netReplyTimeout))
+		_, err = conn.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	e.end(pid)
+}
+
+/*
+ * Ends the run by killing every task of the server started as pid,
+ * unless the harness stops the exchange within the grace period as the
+ * program has already stopped or exited.
+ */
+func (e *netExchange) end(pid int) {
+	select {
+	case <-e.stopped:
+	case <-time.After(netGracePeriod):
+	}
+	e.mu.Lock()
+	if !e.isStopped() {
+		trackedTasks(pid).kill()
+		e.ended = true
+	}
+	e.mu.Unlock()
+}
+
+func (e *netExchange) isStopped() bool {
+	select {
+	case <-e.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Stops the exchange, once the program has stopped or exited, and
+ * waits for it to finish.
+ * Returns whether the exchange ended the run by killing the program,
+ * and any error which kept it from delivering the input.
+ */
+func (e *netExchange) stop() (bool, error) {
+	e.mu.Lock()
+	close(e.stopped)
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	e.mu.Unlock()
+	<-e.done
+	return e.ended, e.err
+}
+
+/*
+ * Moves the calling thread into the network namespace of process pid.
+ */
+func joinNetNamespace(pid int) error {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return syscall.Setns(int(f.Fd()), syscall.CLONE_NEWNET)
+}
+
+/*
+ * Checks whether a socket of the calling thread's network namespace is
+ * listening on port, for TCP, or bound to it, for UDP.
+ * Returns the loopback address of the family the socket was found in,
+ * or an empty string if there is none.
+ */
+func isListening(proto string, port int) (string, error) {
+	// The thread's own view, as it may have joined another namespace.
+	tables := []struct{ name, loopback string }{
+		{proto, "127.0.0.1"},
+		{proto + "6", "::1"},
+	}
+	for _, table := range tables {
+		f, err := os.Open("/proc/thread-self/net/" + table.name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		found, err := scanSocketTable(f, proto, port)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return table.loopback, nil
+		}
+	}
+	return "", nil
+}
+
+/*
+ * Scans a /proc/net socket table, e.g. /proc/net/tcp, for a socket on
+ * the local port which is listening, or for UDP is bound.
+ */
+func scanSocketTable(f *os.File, proto string, port int) (bool, error) {
+	// TCP_LISTEN in the kernel's socket states.
+	const tcpListen = "0A"
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header.
+	for scanner.Scan() {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		local := fields[1]
+		sep := strings.LastIndex(local, ":")
+		localPort, err := strconv.ParseUint(local[sep+1:], 16, 16)
+		if err != nil || int(localPort) != port {
+			continue
+		}
+		if proto == netUDP || fields[3] == tcpListen {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
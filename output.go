@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+/*
+ * This file contains capture of the program's output and the oracles
+ * which flag runs as findings based on their output and exit code.
+ */
+
+/*
+ * Output of a single program run, cut down to the capture limit.
+ */
+type runOutput struct {
+	stdout []byte
+	stderr []byte
+}
+
+/*
+ * Pipes private to a harness which the program's stdout and stderr are
+ * written to. Each pipe is drained as the program writes, keeping the
+ * first limit bytes of each run and dropping the rest, so a program
+ * printing in a loop neither fills the disk nor blocks on a full pipe.
+ * Copies of a fork server share the server's pipes and are captured
+ * the same way.
+ */
+type outputCapture struct {
+	stdout *outputStream
+	stderr *outputStream
+}
+
+/*
+ * One captured stream.
+ * r: read end of the pipe, drained by drain.
+ * w: write end of the pipe, given to programs.
+ * limit: maximum number of bytes kept from each run.
+ * mu: guards data against drain.
+ * data: output of the current run, up to limit.
+ * synced: signalled by drain once the pipe has been emptied for sync.
+ */
+type outputStream struct {
+	r      *os.File
+	w      *os.File
+	limit  int
+	mu     sync.Mutex
+	data   []byte
+	synced chan struct{}
+}
+
+/*
+ * Creates the capture pipes for a harness, keeping up to limit bytes
+ * of each stream per run.
+ */
+func newOutputCapture(limit int) (*outputCapture, error) {
+	c := &outputCapture{}
+	var err error
+	c.stdout, err = newOutputStream(limit)
+	if err != nil {
+		return nil, err
+	}
+	c.stderr, err = newOutputStream(limit)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newOutputStream(limit int) (*outputStream, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s := &outputStream{r: r, w: w, limit: limit, synced: make(chan struct{})}
+	go s.drain()
+	return s, nil
+}
+
+/*
+ * Reads the pipe until it is closed, keeping what fits in the limit.
+ * A sync is requested by setting a read deadline in the past, which
+ * is answered once the pipe is empty.
+ */
+func (s *outputStream) drain() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.r.Read(buf)
+		s.keep(buf[:n])
+		if err == nil {
+			continue
+		}
+		if !os.IsTimeout(err) {
+			return
+		}
+		// Reads fail straight away once the deadline has passed, so
+		// what is left in the pipe is read after clearing it.
+		s.r.SetReadDeadline(time.Time{})
+		for s.pending() > 0 {
+			n, err = s.r.Read(buf)
+			s.keep(buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		s.synced <- struct{}{}
+	}
+}
+
+/*
+ * Adds output to the current run, up to the limit.
+ */
+func (s *outputStream) keep(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if room := s.limit - len(s.data); room < len(b) {
+		b = b[:room]
+	}
+	s.data = append(s.data, b...)
+}
+
+/*
+ * Returns the number of bytes waiting in the pipe.
+ */
+func (s *outputStream) pending() int {
+	rc, err := s.r.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	// TIOCINQ is FIONREAD, which works on pipes as well.
+	rc.Control(func(fd uintptr) {
+		n, _ = syscall.IoctlGetInt(int(fd), syscall.TIOCINQ)
+	})
+	return n
+}
+
+/*
+ * Waits until everything written to the pipe so far has been drained.
+ * Must only be called while no program can write to the pipe, e.g.
+ * with every program stopped or gone.
+ */
+func (s *outputStream) sync() {
+	s.r.SetReadDeadline(time.Now())
+	<-s.synced
+}
+
+/*
+ * Syncs the stream and returns its output since the last reset, which
+ * is cleared if reset is set.
+ */
+func (s *outputStream) take(reset bool) []byte {
+	s.sync()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := append([]byte{}, s.data...)
+	if reset {
+		s.data = s.data[:0]
+	}
+	return out
+}
+
+/*
+ * Drops output left over from before a run, e.g. printed by a fork
+ * server while it started up.
+ */
+func (c *outputCapture) reset() {
+	c.stdout.take(true)
+	c.stderr.take(true)
+}
+
+/*
+ * Returns the output of the last run, up to the capture limit.
+ */
+func (c *outputCapture) read() runOutput {
+	return runOutput{stdout: c.stdout.take(false), stderr: c.stderr.take(false)}
+}
+
+/*
+ * Closes the capture pipes, which stops draining them.
+ */
+func (c *outputCapture) close() {
+	for _, s := range []*outputStream{c.stdout, c.stderr} {
+		if s != nil {
+			s.w.Close()
+			s.r.Close()
+		}
+	}
+}
+
+/*
+ * Checks a run which neither crashed nor hung against the oracles in
+ * cfg: regular expressions matched against its stdout and stderr and
+ * exit codes which indicate a problem.
+ * Returns a description of the first oracle that matched and whether
+ * any did.
+ */
+func checkOracles(cfg *harnessConfig, ws syscall.WaitStatus, out runOutput) (string, bool) {
+	for _, re := range cfg.outputOracles {
+		if m := re.Find(out.stdout); m != nil {
+			return fmt.Sprintf("stdout matched /%s/: %q", re, m), true
+		}
+		if m := re.Find(out.stderr); m != nil {
+			return fmt.Sprintf("stderr matched /%s/: %q", re, m), true
+		}
+	}
+	if ws.Exited() {
+		for _, code := range cfg.exitOracles {
+			if ws.ExitStatus() == code {
+				return fmt.Sprintf("exit code %d", code), true
+			}
+		}
+	}
+	return "", false
+}
+
+/*
+ * Compiles the output oracle expressions in exprs.
+ */
+func compileOracles(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+ * This file contains the output side of the fuzzer: saving and
+ * deduplicating interesting findings across all harnesses.
+ */
+
+/*
+ * Output directories and deduplication state for findings.
+ * A single findingStore is shared by every harness.
+ * crashDir: directory crashing inputs are saved in.
+ * crashes: saved crashes keyed by their stack signature.
+ * limitDir: directory inputs exceeding resource limits are saved in.
+ * limits: saved resource limit findings keyed by kind and signature.
+ * oracleDir: directory inputs flagged by output or exit code oracles
+ *            are saved in.
+ * oracles: saved oracle findings keyed by the oracle match.
+ * hangDir: directory hanging inputs are saved in.
+ * hangsSeen: signatures of hangs which have already been saved.
+ * hangStacks: saved in-process hangs keyed by the stack signature of
+ *             the hung call.
+ */
+type findingStore struct {
+	mu         sync.Mutex
+	crashDir   string
+	crashes    map[string]*crashBucket
+	limitDir   string
+	limits     map[string]*crashBucket
+	oracleDir  string
+	oracles    map[string]*crashBucket
+	hangDir    string
+	hangsSeen  map[string]bool
+	hangStacks map[string]*crashBucket
+}
+
+/*
+ * A group of crashes sharing a stack signature.
+ * name: file name the bucket's input is saved under.
+ * size: length of the saved input.
+ * hits: number of times a crash has landed in the bucket.
+ * details: crash details of the saved input, see crashInfo.report.
+ */
+type crashBucket struct {
+	name    string
+	size    int
+	hits    int
+	details string
+}
+
+/*
+ * Creates a findingStore saving into outDir, creating the
+ * output directories if they do not already exist.
+ */
+func newFindingStore(outDir string) (*findingStore, error) {
+	s := &findingStore{
+		crashDir:   filepath.Join(outDir, "crashes"),
+		crashes:    make(map[string]*crashBucket),
+		limitDir:   filepath.Join(outDir, "limits"),
+		limits:     make(map[string]*crashBucket),
+		oracleDir:  filepath.Join(outDir, "oracles"),
+		oracles:    make(map[string]*crashBucket),
+		hangDir:    filepath.Join(outDir, "hangs"),
+		hangsSeen:  make(map[string]bool),
+		hangStacks: make(map[string]*crashBucket),
+	}
+	for _, dir := range []string{s.crashDir, s.limitDir, s.oracleDir, s.hangDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+/*
+ * Records an input which crashed the target.
+ * Crashes are bucketed by their stack signature and only the smallest
+ * input seen for each bucket is kept, named by the crash signal, the
+ * time it was found and a hash of its contents. A report holding the
+ * crash details and the bucket's hit count is written next to it.
+ * Returns whether the crash started a new bucket.
+ */
+func (s *findingStore) addCrash(crashCase TestCase, crash crashInfo) (bool, error) {
+	// Crashes found without a signal, e.g. sanitizer reports from a
+	// program which exited or panics in-process, have no signal name.
+	prefix := "crash"
+	if crash.signal != 0 {
+		prefix = syscall.SignalName(crash.signal)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return addToBucket(s.crashDir, s.crashes, crash.signature,
+		prefix, crashCase, crash)
+}
+
+/*
+ * Records an input which made the target exceed a resource limit.
+ * These are bucketed and saved like crashes, but kept apart from them
+ * and bucketed by the kind of limit as well as the stack signature.
+ * Returns whether the finding started a new bucket.
+ */
+func (s *findingStore) addLimit(limitCase TestCase, crash crashInfo) (bool, error) {
+	// Limits reached by programs which exited have no signal name.
+	prefix := "limit"
+	if crash.signal != 0 {
+		prefix = syscall.SignalName(crash.signal)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := crash.class + "/" + crash.signature
+	return addToBucket(s.limitDir, s.limits, key, prefix, limitCase, crash)
+}
+
+/*
+ * Records an input flagged by an output or exit code oracle.
+ * Findings are bucketed by the oracle description, which holds the
+ * matched text, and saved like crashes along with the program output.
+ * Returns whether the finding started a new bucket.
+ */
+func (s *findingStore) addOracle(oracleCase TestCase, desc string, out runOutput) (bool, error) {
+	finding := crashInfo{
+		class:     "oracle: " + desc,
+		signature: fmt.Sprintf("%x", sha1.Sum([]byte(desc)))[:16],
+		output:    out,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return addToBucket(s.oracleDir, s.oracles, finding.signature, "oracle",
+		oracleCase, finding)
+}
+
+/*
+ * Adds a crashing input to the bucket named key in buckets, saving
+ * it and the program's output in dir if it is the first or smallest
+ * input for the bucket. Saved files are named starting with prefix.
+ * Must be called with the findingStore lock held.
+ * Returns whether the bucket is new.
+ */
+func addToBucket(dir string, buckets map[string]*crashBucket, key string,
+	prefix string, crashCase TestCase, crash crashInfo) (bool, error) {
+
+	b, seen := buckets[key]
+	if !seen {
+		b = &crashBucket{}
+		buckets[key] = b
+	}
+	b.hits++
+
+	// Replace the saved input when a smaller one hits the bucket.
+	if !seen || len(crashCase.input) < b.size {
+		if seen {
+			removeFinding(dir, b.name)
+		}
+		b.name = fmt.Sprintf("%s_%d_%s", prefix,
+			time.Now().Unix(), inputHash(crashCase.input))
+		b.size = len(crashCase.input)
+		b.details = crash.report()
+		err := saveFinding(dir, b.name, crashCase)
+		if err == nil {
+			err = saveOutput(dir, b.name, crash.output)
+		}
+		if err != nil {
+			return !seen, err
+		}
+	}
+
+	// The report is rewritten on every hit, so replace it atomically.
+	// Its details stay those of the saved input.
+	report := fmt.Sprintf("%shits: %d\n", b.details, b.hits)
+	path := filepath.Join(dir, b.name+".report")
+	err := ioutil.WriteFile(path+".tmp", []byte(report), 0644)
+	if err != nil {
+		return !seen, err
+	}
+	return !seen, os.Rename(path+".tmp", path)
+}
+
+/*
+ * Records an input which caused the target to hang.
+ * Hangs are deduplicated by the set of syscalls made before the program
+ * was killed, so loops running a different number of times collapse
+ * into a single hang.
+ * Returns whether the hang was new and saved.
+ */
+func (s *findingStore) addHang(hangCase TestCase, t execTrace) (bool, error) {
+	sig := syscallSet(t)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hangsSeen[sig] {
+		return false, nil
+	}
+	s.hangsSeen[sig] = true
+
+	name := fmt.Sprintf("hang_%d_%s", time.Now().Unix(), inputHash(hangCase.input))
+	return true, saveFinding(s.hangDir, name, hangCase)
+}
+
+/*
+ * Records an input which hung a target called in-process.
+ * No syscalls are traced in-process, so these are bucketed by the stack
+ * signature of the hung call instead, and saved like crashes along with
+ * the stack.
+ * Returns whether the hang started a new bucket.
+ */
+func (s *findingStore) addInProcessHang(hangCase TestCase, hang crashInfo) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return addToBucket(s.hangDir, s.hangStacks, hang.signature, "hang",
+		hangCase, hang)
+}
+
+/*
+ * Returns a short hex digest identifying an input.
+ */
+func inputHash(input []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(input))[:16]
+}
+
+/*
+ * Writes the input of a TestCase to dir/name and the changes
+ * made to it to dir/name.changes.
+ */
+func saveFinding(dir, name string, tc TestCase) error {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, tc.input, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".changes", []byte(tc.changesLog()), 0644)
+}
+
+/*
+ * Writes the output of the program to dir/name.stdout and
+ * dir/name.stderr.
+ */
+func saveOutput(dir, name string, out runOutput) error {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path+".stdout", out.stdout, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".stderr", out.stderr, 0644)
+}
+
+/*
+ * Removes every file saved for the finding dir/name.
+ */
+func removeFinding(dir, name string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, name) + "*")
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This file contains the snapshot execution mode. The target is run up
+ * to a snapshot point once, where its registers and writable memory are
+ * saved. Every input is then run from the snapshot point, and instead
+ * of exiting the program is rewound to the snapshot for the next input,
+ * so its startup is only paid for once.
+ * Only single threaded programs are supported, and tasks they create
+ * after the snapshot point are killed when the program is rewound.
+ * Files opened after the snapshot point are closed, and those open at
+ * it are put back from copies made at the snapshot point and rewound.
+ */
+
+/*
+ * Limit on the writable memory saved in a snapshot, which keeps
+ * sanitizer shadow memory and other huge reservations from being read.
+ */
+const maxSnapshotMemory = 256 << 20
+
+/*
+ * Pseudo mappings set up by the kernel which are neither saved nor
+ * restored.
+ */
+var kernelMappings = map[string]bool{
+	"[vdso]": true, "[vvar]": true, "[vvar_vclock]": true, "[vsyscall]": true,
+}
+
+/*
+ * Highest file descriptor the copies of a snapshot's file descriptors
+ * are placed below, so the program's table is not grown far for them.
+ */
+const maxFdCopyTop = 1024
+
+/*
+ * Contents of a writable mapping at the snapshot point.
+ */
+type savedRegion struct {
+	addr uint64
+	data []byte
+}
+
+/*
+ * A file descriptor open at the snapshot point.
+ * pos: its offset.
+ * target: what it refers to, as read from /proc/pid/fd.
+ * copy: duplicate of it made at the snapshot point, which it is put
+ *       back from when the program closes or replaces it.
+ */
+type savedFd struct {
+	pos    int64
+	target string
+	copy   int
+}
+
+/*
+ * Error for program state a snapshot can not be rewound over, which the
+ * program is likely to reach again on every run.
+ */
+type unrestorableError struct {
+	msg string
+}
+
+func (e *unrestorableError) Error() string {
+	return e.msg
+}
+
+/*
+ * A program stopped at its snapshot point, which inputs are run in.
+ * pid: pid of the program.
+ * regs: registers of the program at the snapshot point.
+ * stub: address of the syscallStub placed at the program's ELF entry
+ *       point, which is never run again, for injecting syscalls.
+ * layout: memory mappings of the program at the snapshot point.
+ * contents: contents of the writable mappings in layout.
+ * brk: program break at the snapshot point.
+ * fds: the program's file descriptors at the snapshot point.
+ * mem: the program's /proc/pid/mem, which memory is restored through.
+ * buffer: address inputs are written to, zero to pass them on stdin.
+ * bufferSize: size of the buffer at buffer.
+ */
+type snapshotServer struct {
+	pid        int
+	regs       syscall.PtraceRegs
+	stub       uintptr
+	layout     []memMapping
+	contents   []savedRegion
+	brk        uint64
+	fds        map[int]savedFd
+	mem        *os.File
+	buffer     uintptr
+	bufferSize uint64
+}
+
+/*
+ * Checks the options of the snapshot mode, an empty snapshot point
+ * disabling it.
+ */
+func checkSnapshotMode(cfg *harnessConfig) error {
+	if cfg.snapshotPoint == "" {
+		if cfg.snapshotBuffer != "" {
+			return fmt.Errorf("a buffer needs a snapshot point")
+		}
+		return nil
+	}
+	if cfg.forkServer || cfg.netProto != "" {
+		return fmt.Errorf("snapshots can not be combined with a fork server or network mode")
+	}
+	return nil
+}
+
+/*
+ * Starts the program in cfg and runs it up to cfg.snapshotPoint, where
+ * its state is saved. The program's stdin is read from stdin, its
+ * output is written to capture and inputPath replaces inputPlaceholder
+ * in its arguments.
+ * Must be called from, and the server only used from, a locked OS thread.
+ */
+func startSnapshotServer(cfg *harnessConfig, stdin *os.File, capture *outputCapture,
+	inputPath string) (*snapshotServer, error) {
+	pid, err := startServerProcess(cfg, stdin, capture, inputPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshotServer{pid: pid}
+	err = s.setup(cfg)
+	if err != nil {
+		s.stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+ * Runs the newly started program to its snapshot point and saves it.
+ */
+func (s *snapshotServer) setup(cfg *harnessConfig) error {
+	f, err := elf.Open(cfg.cmd)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.stub, err = relocate(f, cfg.cmd, f.Entry, s.pid)
+	if err != nil {
+		return err
+	}
+	point, _, err := resolveAddress(cfg.cmd, cfg.snapshotPoint, s.pid)
+	if err != nil {
+		return err
+	}
+	if cfg.snapshotBuffer != "" {
+		s.buffer, s.bufferSize, err = resolveAddress(cfg.cmd, cfg.snapshotBuffer, s.pid)
+		if err != nil {
+			return err
+		}
+		if cfg.snapshotBufferSize > 0 {
+			s.bufferSize = uint64(cfg.snapshotBufferSize)
+		}
+		if s.bufferSize == 0 {
+			return fmt.Errorf("size of buffer %s is unknown", cfg.snapshotBuffer)
+		}
+	}
+
+	s.regs, err = runToBreakpoint(s.pid, point)
+	if err != nil {
+		return err
+	}
+	err = s.placeStub()
+	if err != nil {
+		return err
+	}
+	err = s.checkSingleTask()
+	if err != nil {
+		return err
+	}
+	s.brk, _, err = injectSyscall(s.pid, s.regs, s.stub, syscall.SYS_BRK, 0)
+	if err != nil {
+		return err
+	}
+	err = s.saveFds()
+	if err != nil {
+		return err
+	}
+
+	s.mem, err = os.OpenFile(fmt.Sprintf("/proc/%d/mem", s.pid), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	s.layout, err = readMaps(s.pid)
+	if err != nil {
+		return err
+	}
+	var total uint64
+	for _, m := range s.layout {
+		// Shared mappings, such as coverage bitmaps, belong to other
+		// processes as well and are left alone.
+		if kernelMappings[m.path] || m.perms[1] != 'w' || m.perms[3] == 's' {
+			continue
+		}
+		total += m.end - m.start
+		if total > maxSnapshotMemory {
+			return fmt.Errorf("more than %d bytes of writable memory to save", maxSnapshotMemory)
+		}
+		data := make([]byte, m.end-m.start)
+		_, err = s.mem.ReadAt(data, int64(m.start))
+		if err != nil {
+			return fmt.Errorf("failed to save mapping at 0x%x: %s", m.start, err.Error())
+		}
+		s.contents = append(s.contents, savedRegion{m.start, data})
+	}
+	return nil
+}
+
+/*
+ * Rewinds the program to the snapshot point and gives it input, through
+ * the buffer if there is one and otherwise through inputFile, which the
+ * program reads as its stdin and which is rewound for every run.
+ * Returns the pid of the program, ready for traceSyscalls.
+ */
+func (s *snapshotServer) run(inputFile *os.File, input []byte) (int, error) {
+	err := s.restore()
+	if err != nil {
+		return 0, err
+	}
+	if s.buffer != 0 {
+		// Inputs are cut to the buffer and zero padded, which leaves
+		// string inputs terminated unless they fill it.
+		data := make([]byte, s.bufferSize)
+		copy(data, input)
+		_, err = s.mem.WriteAt(data, int64(s.buffer))
+		return s.pid, err
+	}
+	err = writeInputFile(inputFile, input)
+	if err != nil {
+		return 0, err
+	}
+	_, err = inputFile.Seek(0, 0)
+	return s.pid, err
+}
+
+/*
+ * Rewinds the stopped program to the snapshot point: kills the tasks it
+ * created, undoes changes to its memory layout and file descriptors,
+ * then restores its writable memory and registers.
+ */
+func (s *snapshotServer) restore() error {
+	err := s.killChildren()
+	if err == nil {
+		err = s.checkSingleTask()
+	}
+	if err == nil {
+		err = s.restoreLayout()
+	}
+	if err == nil {
+		err = s.restoreFds()
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range s.contents {
+		_, err = s.mem.WriteAt(r.data, int64(r.addr))
+		if err != nil {
+			return fmt.Errorf("failed to restore mapping at 0x%x: %s", r.addr, err.Error())
+		}
+	}
+	// The saved registers hold no syscall number, so a syscall the
+	// program is stopped in is abandoned rather than restarted.
+	return syscall.PtraceSetRegs(s.pid, &s.regs)
+}
+
+/*
+ * Resets the program break, unmaps memory mapped after the snapshot
+ * point and maps writable memory unmapped since again.
+ */
+func (s *snapshotServer) restoreLayout() error {
+	maps, err := readMaps(s.pid)
+	if err != nil {
+		return err
+	}
+	if heapEnd(maps) != heapEnd(s.layout) {
+		_, _, err = s.inject(syscall.SYS_BRK, s.brk)
+		if err != nil {
+			return err
+		}
+		maps, err = readMaps(s.pid)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, m := range maps {
+		if kernelMappings[m.path] {
+			continue
+		}
+		for _, gap := range uncovered(m, s.layout) {
+			ret, _, err := s.inject(syscall.SYS_MUNMAP, gap.start, gap.end-gap.start)
+			if err == nil && ret != 0 {
+				err = syscall.Errno(-int64(ret))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to unmap 0x%x: %s", gap.start, err.Error())
+			}
+		}
+	}
+
+	for _, m := range s.layout {
+		if kernelMappings[m.path] {
+			continue
+		}
+		for _, gap := range uncovered(m, maps) {
+			if m.perms[1] != 'w' {
+				return &unrestorableError{fmt.Sprintf(
+					"mapping at 0x%x was unmapped after the snapshot point", gap.start)}
+			}
+			ret, _, err := s.inject(syscall.SYS_MMAP, gap.start, gap.end-gap.start,
+				syscall.PROT_READ|syscall.PROT_WRITE|protExec(m.perms),
+				syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_FIXED,
+				^uint64(0), 0)
+			if err == nil && ret != gap.start {
+				err = syscall.Errno(-int64(ret))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to map 0x%x again: %s", gap.start, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Records the program's file descriptors and duplicates each of them
+ * to the top of its descriptor table.
+ */
+func (s *snapshotServer) saveFds() error {
+	offsets, err := readFdOffsets(s.pid)
+	if err != nil {
+		return err
+	}
+	var lim syscall.Rlimit
+	err = syscall.Prlimit(s.pid, syscall.RLIMIT_NOFILE, nil, &lim)
+	if err != nil {
+		return err
+	}
+	top := lim.Cur
+	if top > maxFdCopyTop {
+		top = maxFdCopyTop
+	}
+	if top < 2*uint64(len(offsets)) {
+		return fmt.Errorf("too few file descriptors allowed to copy %d", len(offsets))
+	}
+
+	s.fds = make(map[int]savedFd, len(offsets))
+	for fd, pos := range offsets {
+		target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", s.pid, fd))
+		if err != nil {
+			return err
+		}
+		ret, _, err := s.inject(syscall.SYS_FCNTL, uint64(fd), syscall.F_DUPFD_CLOEXEC,
+			top-uint64(len(offsets)))
+		if err == nil && int64(ret) < 0 {
+			err = syscall.Errno(-int64(ret))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy file descriptor %d: %s", fd, err.Error())
+		}
+		s.fds[fd] = savedFd{pos: pos, target: target, copy: int(ret)}
+	}
+	return nil
+}
+
+/*
+ * Closes the file descriptors opened after the snapshot point, puts
+ * back those open at it which were closed or replaced and seeks them
+ * back to their offsets.
+ */
+func (s *snapshotServer) restoreFds() error {
+	offsets, err := readFdOffsets(s.pid)
+	if err != nil {
+		return err
+	}
+	copies := make(map[int]bool, len(s.fds))
+	for fd, f := range s.fds {
+		if _, open := offsets[f.copy]; !open {
+			return &unrestorableError{fmt.Sprintf(
+				"copy of file descriptor %d was closed after the snapshot point", fd)}
+		}
+		copies[f.copy] = true
+	}
+
+	for fd := range offsets {
+		if _, saved := s.fds[fd]; saved || copies[fd] {
+			continue
+		}
+		ret, _, err := s.inject(syscall.SYS_CLOSE, uint64(fd))
+		if err == nil && ret != 0 {
+			err = syscall.Errno(-int64(ret))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to close file descriptor %d: %s", fd, err.Error())
+		}
+	}
+
+	for fd, f := range s.fds {
+		pos, open := offsets[fd]
+		if open {
+			target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", s.pid, fd))
+			open = err == nil && target == f.target
+		}
+		if !open {
+			ret, _, err := s.inject(syscall.SYS_DUP2, uint64(f.copy), uint64(fd))
+			if err == nil && ret != uint64(fd) {
+				err = syscall.Errno(-int64(ret))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to reopen file descriptor %d: %s", fd, err.Error())
+			}
+			// The copy shares its offset with the original.
+			pos = offsets[f.copy]
+		}
+		// Pipes and sockets always read as offset 0, so are never sought.
+		if pos == f.pos {
+			continue
+		}
+		ret, _, err := s.inject(syscall.SYS_LSEEK, uint64(fd), uint64(f.pos),
+			syscall.SEEK_SET)
+		if err == nil && ret != uint64(f.pos) {
+			err = syscall.Errno(-int64(ret))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to seek file descriptor %d: %s", fd, err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+ * Writes the syscall stub over the program's entry point, which must be
+ * done again whenever the code there is overwritten.
+ */
+func (s *snapshotServer) placeStub() error {
+	_, err := syscall.PtracePokeData(s.pid, s.stub, syscallStub)
+	return err
+}
+
+/*
+ * Runs a syscall in the program through the stub.
+ */
+func (s *snapshotServer) inject(nr uint64, args ...uint64) (uint64, int, error) {
+	return injectSyscall(s.pid, s.regs, s.stub, nr, args...)
+}
+
+/*
+ * Checks that the program has no threads besides its main one, which
+ * the snapshot could not rewind.
+ */
+func (s *snapshotServer) checkSingleTask() error {
+	tasks, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", s.pid))
+	if err != nil {
+		return err
+	}
+	if len(tasks) > 1 {
+		return &unrestorableError{fmt.Sprintf(
+			"program has %d threads, snapshots need a single one", len(tasks))}
+	}
+	return nil
+}
+
+/*
+ * Kills and reaps the processes the program created since the snapshot
+ * point. Threads of the program itself are left for checkSingleTask,
+ * as killing one would kill the program.
+ */
+func (s *snapshotServer) killChildren() error {
+	tasks := trackedTasks(s.pid)
+	var children []int
+	for _, tid := range tasks.list() {
+		_, err := os.Stat(fmt.Sprintf("/proc/%d/task/%d", s.pid, tid))
+		if err == nil {
+			continue
+		}
+		children = append(children, tid)
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	err := reapKilled(tasks, children)
+	if err != nil {
+		return err
+	}
+	// The harness collects their status as their tracer, but only the
+	// program as their parent can remove them from the process table.
+	for {
+		ret, _, err := s.inject(syscall.SYS_WAIT4, ^uint64(0), 0,
+			syscall.WNOHANG|syscall.WALL)
+		if err != nil {
+			return err
+		}
+		if int64(ret) <= 0 {
+			return nil
+		}
+	}
+}
+
+/*
+ * Kills the program.
+ */
+func (s *snapshotServer) stop() {
+	if s.mem != nil {
+		s.mem.Close()
+	}
+	killProgram(s.pid)
+}
+
+/*
+ * Reads the exit code of a program stopped on entry to exit_group,
+ * as a status it could have exited with.
+ */
+func exitStatus(pid int) (syscall.WaitStatus, error) {
+	var regs syscall.PtraceRegs
+	err := syscall.PtraceGetRegs(pid, &regs)
+	if err != nil {
+		return 0, err
+	}
+	return syscall.WaitStatus((regs.Rdi & 0xff) << 8), nil
+}
+
+/*
+ * Reads the open file descriptors of process pid from /proc/pid/fdinfo.
+ * Returns the offset of each descriptor.
+ */
+func readFdOffsets(pid int) (map[int]int64, error) {
+	dir := fmt.Sprintf("/proc/%d/fdinfo", pid)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	fds := make(map[int]int64, len(entries))
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		info, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// The first line is "pos:" followed by the offset.
+		fields := strings.Fields(string(info))
+		if len(fields) < 2 || fields[0] != "pos:" {
+			return nil, fmt.Errorf("unexpected fdinfo for file descriptor %d", fd)
+		}
+		fds[fd], err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fds, nil
+}
+
+/*
+ * Returns the end of the heap in maps, zero if it has none.
+ */
+func heapEnd(maps []memMapping) uint64 {
+	for _, m := range maps {
+		if m.path == "[heap]" {
+			return m.end
+		}
+	}
+	return 0
+}
+
+/*
+ * Returns the parts of m which no mapping in maps covers. maps must be
+ * in address order.
+ */
+func uncovered(m memMapping, maps []memMapping) []memMapping {
+	var gaps []memMapping
+	start := m.start
+	for _, o := range maps {
+		if o.end <= start || kernelMappings[o.path] {
+			continue
+		}
+		if o.start >= m.end {
+			break
+		}
+		if o.start > start {
+			gap := m
+			gap.start, gap.end = start, o.start
+			gaps = append(gaps, gap)
+		}
+		start = o.end
+		if start >= m.end {
+			return gaps
+		}
+	}
+	gap := m
+	gap.start = start
+	return append(gaps, gap)
+}
+
+/*
+ * Returns PROT_EXEC if the permission string perms is executable.
+ */
+func protExec(perms string) uint64 {
+	if strings.Contains(perms, "x") {
+		return syscall.PROT_EXEC
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This file contains the resource limits applied to every program the
+ * harness starts and the detection of runs which exceeded them.
+ */
+
+/*
+ * Resources which can be limited, by the name used on the command line.
+ */
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"core":   syscall.RLIMIT_CORE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"cpu":    syscall.RLIMIT_CPU,
+}
+
+/*
+ * A limit on a single resource.
+ * resource: RLIMIT_* constant of the resource.
+ * value: limit in bytes, file descriptors or seconds of CPU time.
+ */
+type rlimit struct {
+	resource int
+	value    uint64
+}
+
+/*
+ * Parses a limit of the form "name=value", where value may have a
+ * K, M or G suffix or be "unlimited".
+ */
+func parseRlimit(s string) (rlimit, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return rlimit{}, fmt.Errorf("limit %q is not of the form name=value", s)
+	}
+	resource, ok := rlimitResources[parts[0]]
+	if !ok {
+		return rlimit{}, fmt.Errorf("unknown resource %q", parts[0])
+	}
+	if parts[1] == "unlimited" {
+		return rlimit{resource: resource, value: syscall.RLIM_INFINITY}, nil
+	}
+
+	num := strings.TrimRight(parts[1], "KMG")
+	value, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return rlimit{}, fmt.Errorf("bad limit value %q", parts[1])
+	}
+	switch strings.TrimPrefix(parts[1], num) {
+	case "K":
+		value <<= 10
+	case "M":
+		value <<= 20
+	case "G":
+		value <<= 30
+	case "":
+	default:
+		return rlimit{}, fmt.Errorf("bad limit value %q", parts[1])
+	}
+	return rlimit{resource: resource, value: value}, nil
+}
+
+/*
+ * Builds the limits to apply from the "name=value" strings in specs.
+ * Core dumps are disabled unless specs say otherwise.
+ */
+func buildRlimits(specs []string) ([]rlimit, error) {
+	limits := []rlimit{{resource: syscall.RLIMIT_CORE, value: 0}}
+	for _, spec := range specs {
+		l, err := parseRlimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+/*
+ * Applies limits to the process pid. Later limits on a resource
+ * override earlier ones.
+ * The hard CPU limit is set a second past the soft limit so the
+ * program is sent SIGXCPU before it is killed.
+ */
+func applyRlimits(pid int, limits []rlimit) error {
+	for _, l := range limits {
+		lim := syscall.Rlimit{Cur: l.value, Max: l.value}
+		if l.resource == syscall.RLIMIT_CPU && l.value != syscall.RLIM_INFINITY {
+			lim.Max++
+		}
+		err := syscall.Prlimit(pid, l.resource, &lim, nil)
+		if err != nil {
+			return fmt.Errorf("failed to set resource limit %d: %s",
+				l.resource, err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+ * Checks whether a run reached a resource limit: it was stopped by
+ * SIGXFSZ or SIGXCPU, it was killed with SIGKILL by something other
+ * than the harness while its memory was limited, or it exited after a
+ * syscall failed with ENOMEM or EMFILE while that resource was limited.
+ * Programs crashing with any other signal stay crashes, as the failed
+ * syscall may have nothing to do with the crash.
+ * crash and crashed describe the run, which must not have hung, and
+ * limits are the limits it ran under.
+ * Returns the kind of limit reached and whether one was.
+ */
+func resourceLimitHit(crash crashInfo, crashed bool, t execTrace,
+	limits []rlimit) (string, bool) {
+	if crashed {
+		switch {
+		case crash.signal == syscall.SIGXFSZ:
+			return "file size", true
+		case crash.signal == syscall.SIGXCPU:
+			return "cpu time", true
+		case crash.signal == syscall.SIGKILL && isLimited(limits, syscall.RLIMIT_AS):
+			return "out of memory", true
+		}
+		return "", false
+	}
+	switch {
+	case t.limitErr == syscall.ENOMEM && isLimited(limits, syscall.RLIMIT_AS):
+		return "out of memory", true
+	case t.limitErr == syscall.EMFILE && isLimited(limits, syscall.RLIMIT_NOFILE):
+		return "open files", true
+	}
+	return "", false
+}
+
+/*
+ * Checks whether limits cap resource for the program. Failures and
+ * SIGKILLs are only put down to limits the fuzzer set.
+ */
+func isLimited(limits []rlimit, resource int) bool {
+	limited := false
+	// Later limits override earlier ones, as in applyRlimits.
+	for _, l := range limits {
+		if l.resource == resource {
+			limited = l.value != syscall.RLIM_INFINITY
+		}
+	}
+	return limited
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	// Only for the id mappings of exec.Cmd, which x/sys does not have.
+	gosyscall "syscall"
+	"unsafe"
+)
+
+/*
+ * This file contains the optional sandbox for the fuzzed program.
+ * The program is started through a copy of the fuzzer running as
+ * sandboxInitArg inside new user, mount, pid, net, ipc and uts
+ * namespaces. The copy sets up the filesystem view, installs a seccomp
+ * filter, asks to be traced and then executes the program, so the
+ * harness traces the program exactly as it does outside the sandbox.
+ */
+
+/*
+ * Name the fuzzer is started under to set up the sandbox.
+ */
+const sandboxInitArg = "fuzzer-sandbox-init"
+
+/*
+ * Filesystem views of the sandbox.
+ * sandboxReadOnly: every mount is read-only.
+ * sandboxTmpfs: every mount is read-only, except for the directories in
+ *               sandboxScratchDirs and the working directory, which are
+ *               overlaid with a tmpfs that discards writes after the run.
+ */
+const (
+	sandboxReadOnly = "ro"
+	sandboxTmpfs    = "tmpfs"
+)
+
+/*
+ * Directories the program may write to in the tmpfs view.
+ */
+var sandboxScratchDirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+
+/*
+ * Syscalls which fail with EPERM in the sandbox. These would let the
+ * program change its sandbox or reach the kernel's more exposed
+ * interfaces.
+ */
+var sandboxDeniedSyscalls = []uint32{
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_SETNS,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_KEXEC_FILE_LOAD,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_FINIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_BPF,
+	syscall.SYS_KEYCTL,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_PERF_EVENT_OPEN,
+	syscall.SYS_USERFAULTFD,
+}
+
+/*
+ * Checks that mode names a filesystem view, empty disabling the sandbox.
+ */
+func checkSandboxMode(mode string) error {
+	switch mode {
+	case "", sandboxReadOnly, sandboxTmpfs:
+		return nil
+	}
+	return fmt.Errorf("unknown sandbox %q, expected %s or %s",
+		mode, sandboxReadOnly, sandboxTmpfs)
+}
+
+/*
+ * Builds the command running the program in cfg with args. The program
+ * is traced from its first instruction and runs in its own process
+ * group, inside the sandbox if one is configured.
+ */
+func targetCommand(cfg *harnessConfig, args []string) *exec.Cmd {
+	if cfg.sandbox == "" {
+		procCmd := exec.Command(cfg.cmd, args...)
+		procCmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true, Setpgid: true}
+		return procCmd
+	}
+
+	// The sandbox init process traces itself before executing the
+	// program, so it is not started traced.
+	initArgs := append([]string{cfg.sandbox, cfg.sandboxDir, cfg.cmd}, args...)
+	procCmd := exec.Command("/proc/self/exe", initArgs...)
+	procCmd.Args[0] = sandboxInitArg
+	procCmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []gosyscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []gosyscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	return procCmd
+}
+
+func init() {
+	// The sandbox init process must trace itself and execute the
+	// program from the same thread.
+	if len(os.Args) > 0 && os.Args[0] == sandboxInitArg {
+		runtime.LockOSThread()
+	}
+}
+
+/*
+ * Entry point of the sandbox init process, started by targetCommand
+ * with the filesystem view, a scratch directory for the tmpfs view,
+ * the program and its arguments. Never returns.
+ */
+func sandboxInit(args []string) {
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "sandbox: missing arguments")
+		os.Exit(127)
+	}
+	mode, scratch, cmd := args[0], args[1], args[2]
+	err := setupSandbox(mode, scratch)
+	if err == nil {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PTRACE, syscall.PTRACE_TRACEME, 0, 0)
+		if errno != 0 {
+			err = errno
+		}
+	}
+	if err == nil {
+		err = syscall.Exec(cmd, args[2:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "sandbox: %s\n", err.Error())
+	os.Exit(127)
+}
+
+/*
+ * Sets up the filesystem view, network and seccomp filter of the
+ * sandbox from inside its namespaces.
+ */
+func setupSandbox(mode, scratch string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// Keep mount changes inside the sandbox.
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %s", err.Error())
+	}
+	mounts, err := readMountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mp := range mounts {
+		err = remountReadOnly(mp)
+		if err != nil {
+			return fmt.Errorf("failed to make %s read-only: %s", mp, err.Error())
+		}
+	}
+	if mode == sandboxTmpfs {
+		err = overlayScratchDirs(scratch, append(sandboxScratchDirs, cwd))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Show the sandbox's own processes. This fails where parts of /proc
+	// are hidden from the fuzzer, leaving the fuzzer's view in place.
+	syscall.Mount("proc", "/proc", "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	// The net namespace has no devices but loopback, which starts down.
+	err = loopbackUp()
+	if err != nil {
+		return fmt.Errorf("failed to bring up loopback: %s", err.Error())
+	}
+	syscall.Sethostname([]byte("sandbox"))
+
+	err = os.Chdir(cwd)
+	if err != nil {
+		return err
+	}
+	return installSeccomp()
+}
+
+/*
+ * Reads the mount points of the current mount namespace.
+ */
+func readMountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point is the fifth field, with spaces escaped.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mp := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n",
+			`\134`, `\`).Replace(fields[4])
+		mounts = append(mounts, mp)
+	}
+	return mounts, scanner.Err()
+}
+
+/*
+ * Makes the mount at mp read-only. Kernel filesystems are skipped,
+ * devices under /dev stay usable either way.
+ */
+func remountReadOnly(mp string) error {
+	for _, skip := range []string{"/proc", "/sys", "/dev"} {
+		if mp == skip || strings.HasPrefix(mp, skip+"/") {
+			return nil
+		}
+	}
+	var st syscall.Statfs_t
+	err := syscall.Statfs(mp, &st)
+	if err != nil {
+		// Mounts hidden under other mounts can not be reached.
+		return nil
+	}
+	// Flags locked by the mount's owner must be kept when remounting.
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	lockable := map[int64]uintptr{
+		syscall.ST_NOSUID:     syscall.MS_NOSUID,
+		syscall.ST_NODEV:      syscall.MS_NODEV,
+		syscall.ST_NOEXEC:     syscall.MS_NOEXEC,
+		syscall.ST_NOATIME:    syscall.MS_NOATIME,
+		syscall.ST_NODIRATIME: syscall.MS_NODIRATIME,
+		syscall.ST_RELATIME:   syscall.MS_RELATIME,
+	}
+	for stFlag, msFlag := range lockable {
+		if st.Flags&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	err = syscall.Mount("", mp, "", flags, "")
+	if err == syscall.EINVAL {
+		// Not a mount point of its own, e.g. a mount over a file.
+		return nil
+	}
+	return err
+}
+
+/*
+ * Overlays each directory in dirs with a writable tmpfs so the program
+ * sees their contents but its writes are thrown away. The tmpfs is
+ * mounted on scratch, so any directory holding scratch is overlaid
+ * last and directories inside another overlaid one are skipped.
+ */
+func overlayScratchDirs(scratch string, dirs []string) error {
+	err := syscall.Mount("tmpfs", scratch, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "")
+	if err != nil {
+		return fmt.Errorf("failed to mount tmpfs: %s", err.Error())
+	}
+
+	var first, last []string
+	for _, dir := range dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() || dir == "/" {
+			continue
+		}
+		nested := false
+		for _, other := range dirs {
+			if other != "/" && other != dir && strings.HasPrefix(dir, other+"/") {
+				nested = true
+			}
+		}
+		if nested {
+			continue
+		}
+		if strings.HasPrefix(scratch, dir+"/") {
+			last = append(last, dir)
+		} else {
+			first = append(first, dir)
+		}
+	}
+
+	for i, dir := range append(first, last...) {
+		upper := filepath.Join(scratch, fmt.Sprintf("upper%d", i))
+		work := filepath.Join(scratch, fmt.Sprintf("work%d", i))
+		for _, d := range []string{upper, work} {
+			err = os.Mkdir(d, 0755)
+			if err != nil {
+				return err
+			}
+		}
+		opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", dir, upper, work)
+		err = syscall.Mount("overlay", dir, "overlay", 0, opts)
+		if err != nil {
+			return fmt.Errorf("failed to overlay %s: %s", dir, err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+ * Brings up the loopback device, the only network device the program
+ * can use.
+ */
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	ifr, err := syscall.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	ifr.SetUint16(syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING)
+	return syscall.IoctlIfreq(fd, syscall.SIOCSIFFLAGS, ifr)
+}
+
+/*
+ * Installs a seccomp filter failing sandboxDeniedSyscalls with EPERM.
+ * The filter is kept across the program's execution.
+ */
+func installSeccomp() error {
+	const (
+		dataNr   = 0
+		dataArch = 4
+		// Syscalls of the x32 ABI, which the filter does not list.
+		x32Bit = 0x40000000
+	)
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	deny := uint32(syscall.SECCOMP_RET_ERRNO) | uint32(syscall.EPERM)
+
+	filter := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, dataArch),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, syscall.AUDIT_ARCH_X86_64, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, syscall.SECCOMP_RET_KILL_PROCESS),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, dataNr),
+		jump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32Bit, 0, 1),
+		stmt(syscall.BPF_RET|syscall.BPF_K, deny),
+	}
+	for _, nr := range sandboxDeniedSyscalls {
+		filter = append(filter,
+			jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, 1),
+			stmt(syscall.BPF_RET|syscall.BPF_K, deny))
+	}
+	filter = append(filter, stmt(syscall.BPF_RET|syscall.BPF_K, syscall.SECCOMP_RET_ALLOW))
+
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	err := syscall.Prctl(syscall.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	return syscall.Prctl(syscall.PR_SET_SECCOMP, syscall.SECCOMP_MODE_FILTER,
+		uintptr(unsafe.Pointer(&prog)), 0, 0)
+}
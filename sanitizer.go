@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This file contains the parser for reports printed by ASan, UBSan,
+ * MSan and the other sanitizers, which are used as a crash oracle.
+ */
+
+/*
+ * Error found by a sanitizer.
+ * sanitizer: name of the sanitizer, e.g. "AddressSanitizer".
+ * bugType: kind of error, e.g. "heap-buffer-overflow".
+ * access: "READ" or "WRITE" for bad memory accesses, otherwise empty.
+ * size: size of the bad access in bytes, zero if not reported, as for
+ *       SEGVs.
+ * nearNull: whether a SEGV was on an address near null.
+ * frames: frames of the error's stack trace, innermost first, with
+ *         their addresses removed.
+ */
+type sanitizerReport struct {
+	sanitizer string
+	bugType   string
+	access    string
+	size      int
+	nearNull  bool
+	frames    []string
+}
+
+var (
+	sanitizerHeaderRe  = regexp.MustCompile(`==\d+==(?:ERROR|WARNING): (\w+Sanitizer): ([\w-]+)`)
+	sanitizerSummaryRe = regexp.MustCompile(`SUMMARY: (\w+Sanitizer): ([\w-]+)`)
+	sanitizerAccessRe  = regexp.MustCompile(`(READ|WRITE) of size (\d+)`)
+	sanitizerSegvRe    = regexp.MustCompile(`SEGV on unknown address (?:0x([0-9a-fA-F]+))?`)
+	sanitizerSignalRe  = regexp.MustCompile(`The signal is caused by a (READ|WRITE) memory access`)
+	sanitizerFrameRe   = regexp.MustCompile(`^\s*#(\d+) 0x[0-9a-fA-F]+ (?:in )?(.*)$`)
+	ubsanErrorRe       = regexp.MustCompile(`(\S+:\d+:\d+): runtime error: ([^:\n]+)`)
+)
+
+/*
+ * Parses the first sanitizer report in the stderr of a run.
+ * Returns the report and whether one was found.
+ */
+func parseSanitizerReport(stderr []byte) (sanitizerReport, bool) {
+	var r sanitizerReport
+	if !bytes.Contains(stderr, []byte("Sanitizer")) &&
+		!bytes.Contains(stderr, []byte("runtime error:")) {
+		return r, false
+	}
+	text := string(stderr)
+
+	// The summary names the bug more precisely than the header for
+	// some errors, such as double-free.
+	if m := sanitizerSummaryRe.FindStringSubmatch(text); m != nil {
+		r.sanitizer, r.bugType = m[1], m[2]
+	} else if m := sanitizerHeaderRe.FindStringSubmatch(text); m != nil {
+		r.sanitizer, r.bugType = m[1], m[2]
+	}
+
+	// UBSan names the check in its message, with the location first.
+	if m := ubsanErrorRe.FindStringSubmatch(text); m != nil &&
+		(r.sanitizer == "" || r.sanitizer == "UndefinedBehaviorSanitizer") {
+		r.sanitizer = "UndefinedBehaviorSanitizer"
+		r.bugType = ubsanBugType(m[2])
+		r.frames = []string{m[1]}
+	}
+	if r.sanitizer == "" {
+		return r, false
+	}
+
+	if m := sanitizerAccessRe.FindStringSubmatch(text); m != nil {
+		r.access = m[1]
+		r.size, _ = strconv.Atoi(m[2])
+	}
+	// SEGVs name the kind of access on a line of its own, without a
+	// size. High addresses fault without one.
+	if m := sanitizerSegvRe.FindStringSubmatch(text); m != nil {
+		if m[1] != "" {
+			addr, err := strconv.ParseUint(m[1], 16, 64)
+			r.nearNull = err == nil && addr < nearNullLimit
+		}
+		if m := sanitizerSignalRe.FindStringSubmatch(text); m != nil {
+			r.access = m[1]
+		}
+	}
+
+	// Only the first stack is the error's, later ones show where
+	// memory was allocated or freed.
+	var stack []string
+	for _, line := range strings.Split(text, "\n") {
+		m := sanitizerFrameRe.FindStringSubmatch(line)
+		if m == nil {
+			if len(stack) > 0 {
+				break
+			}
+			continue
+		}
+		if m[1] == "0" && len(stack) > 0 {
+			break
+		}
+		stack = append(stack, strings.TrimSpace(m[2]))
+	}
+	if len(stack) > 0 {
+		r.frames = stack
+	}
+	return r, true
+}
+
+/*
+ * Turns a UBSan message such as "signed integer overflow" into a bug
+ * type such as "signed-integer-overflow", dropping the values and
+ * types which vary between runs.
+ */
+func ubsanBugType(msg string) string {
+	var words []string
+	for _, w := range strings.Fields(msg) {
+		if strings.ContainsAny(w, "0123456789'\"") {
+			continue
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, "-")
+}
+
+/*
+ * Describes the report as a crash class, e.g.
+ * "AddressSanitizer: heap-buffer-overflow (READ of size 4)" or
+ * "AddressSanitizer: SEGV (WRITE)".
+ */
+func (r sanitizerReport) class() string {
+	class := r.sanitizer + ": " + r.bugType
+	switch {
+	case r.access != "" && r.size > 0:
+		class += fmt.Sprintf(" (%s of size %d)", r.access, r.size)
+	case r.access != "":
+		class += fmt.Sprintf(" (%s)", r.access)
+	}
+	return class
+}
+
+/*
+ * Replaces the class, stack and triage of a crash with those from the
+ * sanitizer report, keeping at most maxFrames frames, and buckets the
+ * crash by the bug type and those frames.
+ */
+func (r sanitizerReport) applyTo(c *crashInfo, maxFrames int) {
+	frames := r.frames
+	if len(frames) > maxFrames {
+		frames = frames[:maxFrames]
+	}
+	c.class = r.class()
+	c.pcs = nil
+	c.frames = frames
+	c.triage = sanitizerTriage(r)
+	c.signature = stackSignature(c.signal, append([]string{r.bugType}, frames...))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+/*
+ * Reports printed by gcc's ASan and UBSan runtimes and, from the clang
+ * documentation, by MSan.
+ */
+const (
+	asanHeapOverflow = `=================================================================
+==13475==ERROR: AddressSanitizer: heap-buffer-overflow on address 0x602000000018 at pc 0x55b6cd4033fb bp 0x7ffe7c8e2ed0 sp 0x7ffe7c8e2ec8
+WRITE of size 1 at 0x602000000018 thread T0
+    #0 0x55b6cd4033fa in main /tmp/san/a.c:6
+    #1 0x7fb790645249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+    #2 0x7fb790645304 in __libc_start_main (/lib/x86_64-linux-gnu/libc.so.6+0x27304)
+    #3 0x55b6cd403170 in _start (/tmp/san/a+0x2170)
+
+0x602000000018 is located 0 bytes to the right of 8-byte region [0x602000000010,0x602000000018)
+allocated by thread T0 here:
+    #0 0x7fb7910b89cf in __interceptor_malloc ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:69
+    #1 0x55b6cd403372 in main /tmp/san/a.c:6
+    #2 0x7fb790645249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+SUMMARY: AddressSanitizer: heap-buffer-overflow /tmp/san/a.c:6 in main
+Shadow bytes around the buggy address:
+=>0x0c047fff8000: fa fa 00[fa]fa fa fa fa fa fa fa fa fa fa fa fa
+==13475==ABORTING
+`
+	asanUseAfterFree = `=================================================================
+==13477==ERROR: AddressSanitizer: heap-use-after-free on address 0x602000000010 at pc 0x558d6c1af481 bp 0x7ffe67cabf50 sp 0x7ffe67cabf48
+READ of size 1 at 0x602000000010 thread T0
+    #0 0x558d6c1af480 in main /tmp/san/a.c:7
+    #1 0x7f430e845249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+0x602000000010 is located 0 bytes inside of 8-byte region [0x602000000010,0x602000000018)
+freed by thread T0 here:
+    #0 0x7f430f2b76a8 in __interceptor_free ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:52
+    #1 0x558d6c1af431 in main /tmp/san/a.c:7
+
+SUMMARY: AddressSanitizer: heap-use-after-free /tmp/san/a.c:7 in main
+==13477==ABORTING
+`
+	asanDoubleFree = `=================================================================
+==13484==ERROR: AddressSanitizer: attempting double-free on 0x602000000010 in thread T0:
+    #0 0x7f9c5c8b76a8 in __interceptor_free ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:52
+    #1 0x563b1a9f357f in main /tmp/san/a.c:10
+    #2 0x7f9c5be45249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+0x602000000010 is located 0 bytes inside of 8-byte region [0x602000000010,0x602000000018)
+freed by thread T0 here:
+    #0 0x7f9c5c8b76a8 in __interceptor_free ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:52
+    #1 0x563b1a9f3573 in main /tmp/san/a.c:10
+
+SUMMARY: AddressSanitizer: double-free ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:52 in __interceptor_free
+==13484==ABORTING
+`
+	asanNullWrite = `a.c:8:35: runtime error: store to null pointer of type 'volatile int'
+AddressSanitizer:DEADLYSIGNAL
+=================================================================
+==13479==ERROR: AddressSanitizer: SEGV on unknown address 0x000000000000 (pc 0x5609beab24fa bp 0x7ffdd0512cd0 sp 0x7ffdd0512c30 T0)
+==13479==The signal is caused by a WRITE memory access.
+==13479==Hint: address points to the zero page.
+    #0 0x5609beab24fa in main /tmp/san/a.c:8
+    #1 0x7fab59045249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+AddressSanitizer can not provide additional info.
+SUMMARY: AddressSanitizer: SEGV /tmp/san/a.c:8 in main
+==13479==ABORTING
+`
+	asanWildWrite = `AddressSanitizer:DEADLYSIGNAL
+=================================================================
+==13502==ERROR: AddressSanitizer: SEGV on unknown address 0x7f0000000000 (pc 0x562cf022e253 bp 0x7fffaa5c1420 sp 0x7fffaa5c1410 T0)
+==13502==The signal is caused by a WRITE memory access.
+    #0 0x562cf022e253 in main /tmp/san/b.c:4
+    #1 0x7fa9c2245249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+AddressSanitizer can not provide additional info.
+SUMMARY: AddressSanitizer: SEGV /tmp/san/b.c:4 in main
+==13502==ABORTING
+`
+	asanHighRead = `AddressSanitizer:DEADLYSIGNAL
+=================================================================
+==13500==ERROR: AddressSanitizer: SEGV on unknown address (pc 0x5602c7d3b1db bp 0x7ffcd9106d80 sp 0x7ffcd9106d70 T0)
+==13500==The signal is caused by a READ memory access.
+==13500==Hint: this fault was caused by a dereference of a high value address (see register values below).  Disassemble the provided pc to learn which register was used.
+    #0 0x5602c7d3b1db in main /tmp/san/b.c:3
+    #1 0x7fafaf445249  (/lib/x86_64-linux-gnu/libc.so.6+0x27249)
+
+AddressSanitizer can not provide additional info.
+SUMMARY: AddressSanitizer: SEGV /tmp/san/b.c:3 in main
+==13500==ABORTING
+`
+	ubsanOverflow = `a.c:9:44: runtime error: signed integer overflow: 2 + 2147483647 cannot be represented in type 'int'
+`
+	msanUninit = `==63929==WARNING: MemorySanitizer: use-of-uninitialized-value
+    #0 0x7f7ae0a1c7b4 in main umr.cc:6
+    #1 0x7f7ae05ac76c in __libc_start_main libc-start.c:226
+
+SUMMARY: MemorySanitizer: use-of-uninitialized-value umr.cc:6 main
+Exiting
+`
+)
+
+/*
+ * Checks the bug, access and frames parsed from each kind of report,
+ * and the class and triage rank they give the crash.
+ */
+func TestParseSanitizerReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   sanitizerReport
+		class  string
+		rank   string
+	}{
+		{
+			name:   "heap-buffer-overflow",
+			stderr: asanHeapOverflow,
+			want: sanitizerReport{
+				sanitizer: "AddressSanitizer", bugType: "heap-buffer-overflow",
+				access: "WRITE", size: 1,
+				frames: []string{
+					"main /tmp/san/a.c:6",
+					"(/lib/x86_64-linux-gnu/libc.so.6+0x27249)",
+					"__libc_start_main (/lib/x86_64-linux-gnu/libc.so.6+0x27304)",
+					"_start (/tmp/san/a+0x2170)",
+				},
+			},
+			class: "AddressSanitizer: heap-buffer-overflow (WRITE of size 1)",
+			rank:  rankExploitable,
+		},
+		{
+			name:   "heap-use-after-free",
+			stderr: asanUseAfterFree,
+			want: sanitizerReport{
+				sanitizer: "AddressSanitizer", bugType: "heap-use-after-free",
+				access: "READ", size: 1,
+				frames: []string{
+					"main /tmp/san/a.c:7",
+					"(/lib/x86_64-linux-gnu/libc.so.6+0x27249)",
+				},
+			},
+			class: "AddressSanitizer: heap-use-after-free (READ of size 1)",
+			rank:  rankExploitable,
+		},
+		{
+			name:   "double-free",
+			stderr: asanDoubleFree,
+			want: sanitizerReport{
+				sanitizer: "AddressSanitizer", bugType: "double-free",
+				frames: []string{
+					"__interceptor_free ../../../../src/libsanitizer/asan/asan_malloc_linux.cpp:52",
+					"main /tmp/san/a.c:10",
+					"(/lib/x86_64-linux-gnu/libc.so.6+0x27249)",
+				},
+			},
+			class: "AddressSanitizer: double-free",
+			rank:  rankExploitable,
+		},
+		{
+			name:   "null write SEGV",
+			stderr: asanNullWrite,
+			want: sanitizerReport{
+				sanitizer: "AddressSanitizer", bugType: "SEGV",
+				access: "WRITE", nearNull: true,
+				frames: []string{
+					"main /tmp/san/a.c:8",
+					"(/lib/x86_64-linux-gnu/libc.so.6+0x27249)",
+				},
+			},
+			class: "AddressSanitizer: SEGV (WRITE)",
+			rank:  rankProbablyNot,
+		},
+		{
+			name:   "wild write SEGV",
+			stderr: asanWildWrite,
+			want: sanitizerReport{
+				sanitizer: "AddressSanitizer", bugType: "SEGV",
+				access: "WRITE",
+				frames: []string{
+					"main /tmp/san/b.c:4",
+					"(/lib/x86_64-linux-gnu/libc.so.6+0x27249)",
+				},
+			},
+			class: "AddressSanitizer: SEGV (WRITE)",
+			rank:  rankExploitable,
+		},
+		{
+			name:   "high address SEGV",
+			stderr: asanHighRead,
+			want: sanitizerReport{
+				sanitizer: "AddressSanitizer", bugType: "SEGV",
+				access: "READ",
+				frames: []string{
+					"main /tmp/san/b.c:3",
+					"(/lib/x86_64-linux-gnu/libc.so.6+0x27249)",
+				},
+			},
+			class: "AddressSanitizer: SEGV (READ)",
+			rank:  rankUnknown,
+		},
+		{
+			name:   "signed-integer-overflow",
+			stderr: ubsanOverflow,
+			want: sanitizerReport{
+				sanitizer: "UndefinedBehaviorSanitizer", bugType: "signed-integer-overflow",
+				frames: []string{"a.c:9:44"},
+			},
+			class: "UndefinedBehaviorSanitizer: signed-integer-overflow",
+			rank:  rankUnknown,
+		},
+		{
+			name:   "use-of-uninitialized-value",
+			stderr: msanUninit,
+			want: sanitizerReport{
+				sanitizer: "MemorySanitizer", bugType: "use-of-uninitialized-value",
+				frames: []string{
+					"main umr.cc:6",
+					"__libc_start_main libc-start.c:226",
+				},
+			},
+			class: "MemorySanitizer: use-of-uninitialized-value",
+			rank:  rankUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := parseSanitizerReport([]byte(tt.stderr))
+			if !ok {
+				t.Fatal("no report found")
+			}
+			if !reflect.DeepEqual(r, tt.want) {
+				t.Errorf("got %+v, want %+v", r, tt.want)
+			}
+			if class := r.class(); class != tt.class {
+				t.Errorf("class %q, want %q", class, tt.class)
+			}
+			if rank := sanitizerTriage(r).rank; rank != tt.rank {
+				t.Errorf("rank %s, want %s", rank, tt.rank)
+			}
+		})
+	}
+}
+
+/*
+ * Checks that output without a sanitizer report is not taken for one.
+ */
+func TestParseSanitizerReportNone(t *testing.T) {
+	for _, stderr := range []string{
+		"",
+		"Segmentation fault (core dumped)\n",
+		"error: Sanitizer option not recognised\n",
+	} {
+		if r, ok := parseSanitizerReport([]byte(stderr)); ok {
+			t.Errorf("found %+v in %q", r, stderr)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+)
+
+/*
+ * This file contains coverage reported by programs instrumented as for
+ * AFL, e.g. built with afl-clang or with
+ * -fsanitize-coverage=trace-pc-guard and a runtime counting edges the
+ * same way. Such programs attach the SysV shared memory segment named
+ * by __AFL_SHM_ID and count the edges they take in it, as a bitmap of
+ * bitmapSize counters.
+ */
+
+/*
+ * Environment variable instrumented programs find the bitmap through.
+ */
+const shmEnvVar = "__AFL_SHM_ID"
+
+/*
+ * A shared memory bitmap private to one harness.
+ * id: id of the SysV shared memory segment.
+ * mem: the segment, as attached by the fuzzer.
+ */
+type shmCoverage struct {
+	id  int
+	mem []byte
+}
+
+/*
+ * Creates and attaches a bitmap. The segment is marked for removal
+ * straight away, so it is freed however the fuzzer exits, which Linux
+ * still lets programs attach it after.
+ */
+func newShmCoverage() (*shmCoverage, error) {
+	id, err := syscall.SysvShmGet(syscall.IPC_PRIVATE, bitmapSize,
+		syscall.IPC_CREAT|syscall.IPC_EXCL|0600)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := syscall.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		syscall.SysvShmCtl(id, syscall.IPC_RMID, nil)
+		return nil, err
+	}
+	_, err = syscall.SysvShmCtl(id, syscall.IPC_RMID, nil)
+	if err != nil {
+		syscall.SysvShmDetach(mem)
+		return nil, err
+	}
+	return &shmCoverage{id: id, mem: mem}, nil
+}
+
+/*
+ * Returns the environment entry giving programs the bitmap.
+ */
+func (s *shmCoverage) env() string {
+	return fmt.Sprintf("%s=%d", shmEnvVar, s.id)
+}
+
+/*
+ * Clears the bitmap before a run.
+ */
+func (s *shmCoverage) reset() {
+	for i := range s.mem {
+		s.mem[i] = 0
+	}
+}
+
+/*
+ * Copies out the edges counted by a run, once the program has stopped.
+ */
+func (s *shmCoverage) read() *transitionBitmap {
+	var b transitionBitmap
+	copy(b[:], s.mem)
+	return &b
+}
+
+/*
+ * Detaches the bitmap, which frees it once no program has it attached.
+ */
+func (s *shmCoverage) close() {
+	syscall.SysvShmDetach(s.mem)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"io/ioutil"
+	"strings"
+	"unsafe"
+)
+
+/*
+ * This file contains the machine state snapshot taken of a program
+ * stopped at a crash, which is written to the crash report.
+ */
+
+/*
+ * Bytes dumped below and above the stack pointer and around the
+ * instruction pointer.
+ */
+const (
+	stackDumpBelow = 64
+	stackDumpAbove = 192
+	codeDumpAround = 32
+)
+
+/*
+ * Machine state of a task stopped at a crash.
+ * regs: registers of the task.
+ * sigCode: si_code of the signal, describing why it was sent.
+ * sigAddr: si_addr of the signal, the faulting address for faults.
+ *          Only valid when sigCode is above zero.
+ * maps: memory layout of the program, as in /proc/pid/maps.
+ * stack: memory around the stack pointer, starting at stackAddr.
+ * code: memory around the instruction pointer, starting at codeAddr.
+ */
+type crashSnapshot struct {
+	regs      syscall.PtraceRegs
+	sigCode   int32
+	sigAddr   uint64
+	maps      string
+	stackAddr uint64
+	stack     []byte
+	codeAddr  uint64
+	code      []byte
+}
+
+/*
+ * Takes a snapshot of task pid, which must be stopped at the delivery
+ * of a crashing signal.
+ */
+func takeSnapshot(pid int) (*crashSnapshot, error) {
+	s := &crashSnapshot{}
+	err := syscall.PtraceGetRegs(pid, &s.regs)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sigCode, s.sigAddr, err = getSigInfo(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	maps, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	s.maps = string(maps)
+
+	s.stackAddr = s.regs.Rsp - stackDumpBelow
+	s.stack = peekAvailable(pid, s.stackAddr, stackDumpBelow+stackDumpAbove)
+	s.codeAddr = s.regs.Rip - codeDumpAround
+	s.code = peekAvailable(pid, s.codeAddr, 2*codeDumpAround)
+	// The code before the instruction pointer may be unmapped, for
+	// instance when it jumped to the start of a mapping.
+	if len(s.code) == 0 {
+		s.codeAddr = s.regs.Rip
+		s.code = peekAvailable(pid, s.codeAddr, codeDumpAround)
+	}
+	return s, nil
+}
+
+/*
+ * Reads up to size bytes of memory from addr in task pid.
+ * Returns the bytes read before the first unreadable address.
+ */
+func peekAvailable(pid int, addr uint64, size int) []byte {
+	buf := make([]byte, size)
+	n, _ := syscall.PtracePeekData(pid, uintptr(addr), buf)
+	return buf[:n]
+}
+
+/*
+ * Names of common si_code values. Values above zero depend on the
+ * signal, the rest mean the signal was sent rather than raised by a
+ * fault.
+ */
+var siCodeNames = map[syscall.Signal]map[int32]string{
+	syscall.SIGSEGV: {1: "SEGV_MAPERR", 2: "SEGV_ACCERR", 3: "SEGV_BNDERR", 4: "SEGV_PKUERR"},
+	syscall.SIGBUS:  {1: "BUS_ADRALN", 2: "BUS_ADRERR", 3: "BUS_OBJERR"},
+	syscall.SIGILL: {1: "ILL_ILLOPC", 2: "ILL_ILLOPN", 3: "ILL_ILLADR", 4: "ILL_ILLTRP",
+		5: "ILL_PRVOPC", 6: "ILL_PRVREG", 7: "ILL_COPROC", 8: "ILL_BADSTK"},
+	syscall.SIGFPE: {1: "FPE_INTDIV", 2: "FPE_INTOVF", 3: "FPE_FLTDIV", 4: "FPE_FLTOVF",
+		5: "FPE_FLTUND", 6: "FPE_FLTRES", 7: "FPE_FLTINV", 8: "FPE_FLTSUB"},
+	syscall.SIGTRAP: {1: "TRAP_BRKPT", 2: "TRAP_TRACE"},
+}
+
+/*
+ * si_code of signals raised by the kernel, e.g. by an int3 trap.
+ */
+const siKernel = 0x80
+
+/*
+ * Reads the siginfo of the signal task pid is stopped at.
+ * Returns its si_code and si_addr.
+ */
+func getSigInfo(pid int) (int32, uint64, error) {
+	// x/sys has no wrapper for PTRACE_GETSIGINFO. The kernel's siginfo
+	// is 128 bytes: signo, errno and code, then si_addr at offset 16.
+	var info [128]byte
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GETSIGINFO,
+		uintptr(pid), 0, uintptr(unsafe.Pointer(&info[0])), 0, 0)
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int32(binary.LittleEndian.Uint32(info[8:12])),
+		binary.LittleEndian.Uint64(info[16:24]), nil
+}
+
+/*
+ * Describes the si_code of signal sig.
+ */
+func siCodeName(sig syscall.Signal, code int32) string {
+	switch code {
+	case 0:
+		return "SI_USER"
+	case siKernel:
+		return "SI_KERNEL"
+	case -1:
+		return "SI_QUEUE"
+	case -6:
+		return "SI_TKILL"
+	}
+	if name, ok := siCodeNames[sig][code]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", code)
+}
+
+/*
+ * Formats the snapshot of a crash caused by sig for a crash report.
+ */
+func (s *crashSnapshot) report(sig syscall.Signal) string {
+	var b strings.Builder
+	// si_addr only holds an address for signals raised by a fault.
+	if s.sigCode > 0 {
+		fmt.Fprintf(&b, "siginfo: si_code=%s si_addr=0x%x\n",
+			siCodeName(sig, s.sigCode), s.sigAddr)
+	} else {
+		fmt.Fprintf(&b, "siginfo: si_code=%s\n", siCodeName(sig, s.sigCode))
+	}
+
+	r := &s.regs
+	regs := []struct {
+		name string
+		val  uint64
+	}{
+		{"rax", r.Rax}, {"rbx", r.Rbx}, {"rcx", r.Rcx}, {"rdx", r.Rdx},
+		{"rsi", r.Rsi}, {"rdi", r.Rdi}, {"rbp", r.Rbp}, {"rsp", r.Rsp},
+		{"r8", r.R8}, {"r9", r.R9}, {"r10", r.R10}, {"r11", r.R11},
+		{"r12", r.R12}, {"r13", r.R13}, {"r14", r.R14}, {"r15", r.R15},
+		{"rip", r.Rip}, {"eflags", r.Eflags}, {"orig_rax", r.Orig_rax},
+		{"cs", r.Cs}, {"ss", r.Ss}, {"ds", r.Ds}, {"es", r.Es},
+		{"fs", r.Fs}, {"gs", r.Gs}, {"fs_base", r.Fs_base}, {"gs_base", r.Gs_base},
+	}
+	b.WriteString("registers:\n")
+	for _, reg := range regs {
+		fmt.Fprintf(&b, "  %-8s 0x%016x\n", reg.name, reg.val)
+	}
+
+	fmt.Fprintf(&b, "stack dump (rsp 0x%x):\n", r.Rsp)
+	b.WriteString(hexDump(s.stackAddr, s.stack))
+	fmt.Fprintf(&b, "code dump (rip 0x%x):\n", r.Rip)
+	b.WriteString(hexDump(s.codeAddr, s.code))
+
+	b.WriteString("memory map:\n")
+	for _, line := range strings.Split(strings.TrimRight(s.maps, "\n"), "\n") {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	return b.String()
+}
+
+/*
+ * Formats data read from addr as lines of 16 hex bytes followed by
+ * their printable characters.
+ */
+func hexDump(addr uint64, data []byte) string {
+	if len(data) == 0 {
+		return "  unreadable\n"
+	}
+	var b strings.Builder
+	for off := 0; off < len(data); off += 16 {
+		line := data[off:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		fmt.Fprintf(&b, "  0x%016x:", addr+uint64(off))
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&b, " %02x", line[i])
+			} else {
+				b.WriteString("   ")
+			}
+		}
+		b.WriteString("  |")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			b.WriteByte(c)
+		}
+		b.WriteString("|\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"strings"
+)
+
+/*
+ * This file contains the call stack unwinder used to bucket crashes.
+ */
+
+/*
+ * Walks the call stack of a stopped program using frame pointers.
+ * The first frame is the current instruction pointer, followed by the
+ * return address of each frame. The walk stops after maxFrames frames,
+ * on a read failure or once a return address leaves executable memory,
+ * which happens when code was built without frame pointers.
+ * Returns the frame addresses, innermost first.
+ */
+func walkStack(pid int, maps []memMapping, maxFrames int) ([]uint64, error) {
+	var regs syscall.PtraceRegs
+	err := syscall.PtraceGetRegs(pid, &regs)
+	if err != nil {
+		return nil, err
+	}
+
+	pcs := []uint64{regs.Rip}
+	fp := regs.Rbp
+	for len(pcs) < maxFrames && fp != 0 {
+		// A frame holds the saved frame pointer then the return address.
+		var frame [16]byte
+		_, err = syscall.PtracePeekData(pid, uintptr(fp), frame[:])
+		if err != nil {
+			break
+		}
+		next := binary.LittleEndian.Uint64(frame[0:8])
+		ret := binary.LittleEndian.Uint64(frame[8:16])
+
+		m, ok := findMapping(maps, ret)
+		if !ok || !strings.Contains(m.perms, "x") {
+			break
+		}
+		pcs = append(pcs, ret)
+
+		// The stack grows down so callers' frames are at higher addresses.
+		if next <= fp {
+			break
+		}
+		fp = next
+	}
+	return pcs, nil
+}
+
+/*
+ * Describes each frame address as a module and offset.
+ */
+func symbolizeStack(maps []memMapping, pcs []uint64) []string {
+	frames := make([]string, len(pcs))
+	for i, pc := range pcs {
+		frames[i] = symbolizeAddr(maps, pc)
+	}
+	return frames
+}
+
+/*
+ * Builds the bucket signature for a crash from its signal and
+ * module relative stack frames.
+ * Returns a hex digest of the signature.
+ */
+func stackSignature(sig syscall.Signal, frames []string) string {
+	h := sha1.New()
+	fmt.Fprintln(h, syscall.SignalName(sig))
+	for _, f := range frames {
+		fmt.Fprintln(h, f)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * This file contains campaign wide statistics shared by all harnesses.
+ */
+
+/*
+ * Number of program runs completed by all harnesses.
+ */
+var execCount uint64
+
+/*
+ * Records a completed program run.
+ */
+func countExec() {
+	atomic.AddUint64(&execCount, 1)
+}
+
+/*
+ * Failed runs and restarts of each harness, by harness id.
+ */
+var harnessErrors = struct {
+	mu       sync.Mutex
+	errors   map[int]uint64
+	restarts map[int]uint64
+}{errors: map[int]uint64{}, restarts: map[int]uint64{}}
+
+/*
+ * Records a failed run of the harness with the given id.
+ */
+func countError(id int) {
+	harnessErrors.mu.Lock()
+	harnessErrors.errors[id]++
+	harnessErrors.mu.Unlock()
+}
+
+/*
+ * Records a restart of the harness with the given id.
+ */
+func countRestart(id int) {
+	harnessErrors.mu.Lock()
+	harnessErrors.restarts[id]++
+	harnessErrors.mu.Unlock()
+}
+
+/*
+ * Describes the failed runs and restarts of every harness which had
+ * any, e.g. "harness 2: 3 errors, 1 restarts".
+ */
+func errorSummary() string {
+	harnessErrors.mu.Lock()
+	defer harnessErrors.mu.Unlock()
+	ids := map[int]bool{}
+	for id := range harnessErrors.errors {
+		ids[id] = true
+	}
+	for id := range harnessErrors.restarts {
+		ids[id] = true
+	}
+	var sorted []int
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+
+	var parts []string
+	for _, id := range sorted {
+		parts = append(parts, fmt.Sprintf("harness %d: %d errors, %d restarts",
+			id, harnessErrors.errors[id], harnessErrors.restarts[id]))
+	}
+	return strings.Join(parts, "; ")
+}
+
+/*
+ * Logs the total number of runs, the rate since the previous report and
+ * the behaviour seen by feedback, if any, and the errors of any harness
+ * which had some, every interval.
+ * Never returns.
+ */
+func reportStats(interval time.Duration, feedback *feedbackManager) {
+	var last uint64
+	lastTime := time.Now()
+	for now := range time.Tick(interval) {
+		total := atomic.LoadUint64(&execCount)
+		rate := float64(total-last) / now.Sub(lastTime).Seconds()
+		if feedback != nil {
+			log.Printf("Stats: %d execs, %.1f execs/sec, %s\n",
+				total, rate, feedback.summary())
+		} else {
+			log.Printf("Stats: %d execs, %.1f execs/sec\n", total, rate)
+		}
+		if errs := errorSummary(); errs != "" {
+			log.Printf("Stats: %s\n", errs)
+		}
+		last, lastTime = total, now
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 )
 
 type TestCase struct {
@@ -23,3 +24,17 @@ func (ts TestCase) printChanges() {
 		fmt.Printf("Change %d: %s", index, value)
 	}
 }
+
+/*
+ * Returns the changes made to the TestCase, one change per line.
+ */
+func (ts TestCase) changesLog() string {
+	var b strings.Builder
+	for index, value := range ts.changes {
+		fmt.Fprintf(&b, "Change %d: %s", index, value)
+		if !strings.HasSuffix(value, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	syscall "golang.org/x/sys/unix"
+	"sort"
+	"strings"
 )
 
 /*
@@ -13,64 +18,273 @@ import (
  * Basic unit of code coverage which forms an execution trace.
  * Generated for every syscall trap.
  * rax: syscall number
+ * task: index of the task making the syscall, in the order the program's
+ *       tasks were created.
+ * exit: whether the trap is the syscall's exit rather than its entry.
+ * fd: class of the file descriptor argument, on entry.
+ * size: class of the size argument, on entry.
+ * ret: class of the return value, on exit.
  */
 type regSet struct {
-	rax uint64
+	rax  uint64
+	task int
+	exit bool
+	fd   fdClass
+	size valueClass
+	ret  valueClass
+}
+
+/*
+ * Classes file descriptor arguments are bucketed into. Descriptors
+ * other than the standard streams vary with what the program has open,
+ * so they share a class.
+ */
+type fdClass uint8
+
+const (
+	fdNone fdClass = iota
+	fdStdin
+	fdStdout
+	fdStderr
+	fdOther
+	fdInvalid
+)
+
+/*
+ * Classes sizes and return values are bucketed into, so runs which only
+ * differ in the amount of data they handle are not told apart.
+ */
+type valueClass uint8
+
+const (
+	classNone valueClass = iota
+	classError
+	classZero
+	classSmall
+	classLarge
+)
+
+/*
+ * Largest value in the small class.
+ */
+const smallValueLimit = 4096
+
+/*
+ * Positions of the file descriptor and size arguments of the syscalls
+ * they are recorded for, -1 where a syscall has none.
+ */
+type argSpec struct {
+	fd   int
+	size int
+}
+
+var syscallArgs = map[uint64]argSpec{
+	syscall.SYS_READ:       {0, 2},
+	syscall.SYS_WRITE:      {0, 2},
+	syscall.SYS_PREAD64:    {0, 2},
+	syscall.SYS_PWRITE64:   {0, 2},
+	syscall.SYS_READV:      {0, -1},
+	syscall.SYS_WRITEV:     {0, -1},
+	syscall.SYS_CLOSE:      {0, -1},
+	syscall.SYS_FSTAT:      {0, -1},
+	syscall.SYS_NEWFSTATAT: {0, -1},
+	syscall.SYS_LSEEK:      {0, -1},
+	syscall.SYS_IOCTL:      {0, -1},
+	syscall.SYS_FCNTL:      {0, -1},
+	syscall.SYS_OPENAT:     {0, -1},
+	syscall.SYS_GETDENTS64: {0, 2},
+	syscall.SYS_FTRUNCATE:  {0, 1},
+	syscall.SYS_MMAP:       {4, 1},
+	syscall.SYS_MUNMAP:     {-1, 1},
+	syscall.SYS_SENDTO:     {0, 2},
+	syscall.SYS_RECVFROM:   {0, 2},
+	syscall.SYS_SENDMSG:    {0, -1},
+	syscall.SYS_RECVMSG:    {0, -1},
+	syscall.SYS_CONNECT:    {0, -1},
+	syscall.SYS_ACCEPT:     {0, -1},
+	syscall.SYS_ACCEPT4:    {0, -1},
+	syscall.SYS_DUP2:       {0, -1},
+	syscall.SYS_DUP3:       {0, -1},
 }
 
 /*
  * Trace of a single program execution.
  * trace: list of regSet structs generated through a program run.
+ * limitErr: first syscall error showing a resource limit was reached,
+ *           ENOMEM or EMFILE, or zero.
+ * blocks: link time addresses of the basic blocks whose breakpoints
+ *         were hit, see blocks.go.
+ * edges: edge hit counts the program reported through shared memory,
+ *        see shm.go, or nil.
  */
 type execTrace struct {
-	trace []regSet
+	trace    []regSet
+	limitErr syscall.Errno
+	blocks   []uint64
+	edges    *transitionBitmap
 }
 
 /*
- * Grabs registers of interest from a register set.
+ * Grabs registers of interest from the register set of a task, which
+ * is at the entry or exit of a syscall. Entries record the classes of
+ * the file descriptor and size arguments, exits that of the return
+ * value.
  * Returns a newly created regSet struct.
  */
-func getInterestingRegs(regs *syscall.PtraceRegs) regSet {
-	r := regSet{rax: regs.Orig_rax}
+func getInterestingRegs(regs *syscall.PtraceRegs, task int, exit bool) regSet {
+	r := regSet{rax: regs.Orig_rax, task: task, exit: exit}
+	if exit {
+		r.ret = classifyValue(int64(regs.Rax))
+		return r
+	}
+	spec, ok := syscallArgs[r.rax]
+	if !ok {
+		return r
+	}
+	args := []uint64{regs.Rdi, regs.Rsi, regs.Rdx, regs.R10, regs.R8, regs.R9}
+	if spec.fd >= 0 {
+		r.fd = classifyFd(int32(args[spec.fd]))
+	}
+	if spec.size >= 0 {
+		r.size = classifyValue(int64(args[spec.size]))
+	}
 	return r
 }
 
 /*
- * Compares two regSet structs.
- * Returns whether they contain the same elements.
+ * Buckets a file descriptor argument.
  */
-func sameRegs(r1, r2 regSet) bool {
-	return r1.rax == r2.rax
+func classifyFd(fd int32) fdClass {
+	switch {
+	case fd < 0:
+		return fdInvalid
+	case fd == 0:
+		return fdStdin
+	case fd == 1:
+		return fdStdout
+	case fd == 2:
+		return fdStderr
+	}
+	return fdOther
 }
 
 /*
- * Compares two execTrace structs.
- * Returns whether they contain the same elements.
+ * Buckets a size or return value. Syscalls return errors as values
+ * from -4095 to -1.
  */
-func sameTrace(t1, t2 execTrace) bool {
-	// Fastpath: length mismatch.
-	if len(t1.trace) != len(t2.trace) {
-		return false
+func classifyValue(v int64) valueClass {
+	switch {
+	case v < 0 && v >= -4095:
+		return classError
+	case v == 0:
+		return classZero
+	case v > 0 && v <= smallValueLimit:
+		return classSmall
 	}
+	return classLarge
+}
 
-	for i := 0; i < len(t1.trace); i++ {
-		if sameRegs(t1.trace[i], t2.trace[i]) == false {
-			return false
-		}
+/*
+ * Checks the return value in a register set for errors caused by
+ * hitting a resource limit. Only meaningful at syscall exits.
+ * Returns the error, or zero if there was none.
+ */
+func getLimitErr(regs *syscall.PtraceRegs) syscall.Errno {
+	switch err := syscall.Errno(-int64(regs.Rax)); err {
+	case syscall.ENOMEM, syscall.EMFILE:
+		return err
+	}
+	return 0
+}
+
+/*
+ * Strong hash identifying a trace, see fingerprint.
+ */
+type traceFingerprint [sha256.Size]byte
+
+/*
+ * Hashes the syscalls of an execTrace. Each regSet is written out in a
+ * fixed width encoding, so traces only share a fingerprint when every
+ * regSet in them is the same.
+ * Returns the fingerprint of the trace.
+ */
+func fingerprint(t execTrace) traceFingerprint {
+	h := sha256.New()
+	var buf [16]byte
+	for _, r := range t.trace {
+		encodeRegs(r, &buf)
+		h.Write(buf[:])
+	}
+	var f traceFingerprint
+	copy(f[:], h.Sum(nil))
+	return f
+}
+
+/*
+ * Writes a regSet to buf in a fixed width encoding.
+ */
+func encodeRegs(r regSet, buf *[16]byte) {
+	binary.LittleEndian.PutUint64(buf[0:], r.rax)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(r.task))
+	buf[12] = 0
+	if r.exit {
+		buf[12] = 1
+	}
+	buf[13], buf[14], buf[15] = byte(r.fd), byte(r.size), byte(r.ret)
+}
+
+/*
+ * Set of the traces seen, kept as fingerprints so lookups take the same
+ * time however many traces have been seen. Full traces are not kept, as
+ * nothing needs them once they have been checked.
+ * Not safe for concurrent use, see feedbackManager.
+ */
+type traceSet struct {
+	seen map[traceFingerprint]bool
+}
+
+func newTraceSet() *traceSet {
+	return &traceSet{seen: map[traceFingerprint]bool{}}
+}
 
+/*
+ * Adds the fingerprint of a trace to the set.
+ * Returns whether the trace was not in the set before.
+ */
+func (s *traceSet) add(f traceFingerprint) bool {
+	if s.seen[f] {
+		return false
 	}
+	s.seen[f] = true
 	return true
 }
 
 /*
- * Checks whether a given execTrace is unique in a slice of execTraces.
- * Returns true if it is unique.
+ * Returns the number of distinct traces in the set.
  */
-func isUniqueTrace(curExecTrace execTrace, listExecTrace []execTrace) bool {
-	for _, t := range listExecTrace {
-		if sameTrace(curExecTrace, t) {
-			return false
+func (s *traceSet) size() int {
+	return len(s.seen)
+}
+
+/*
+ * Summarises an execTrace by the distinct syscalls it contains,
+ * ignoring their order and how often they were made.
+ * Returns the sorted syscall numbers as a string.
+ */
+func syscallSet(t execTrace) string {
+	seen := make(map[uint64]bool)
+	var nums []uint64
+	for _, r := range t.trace {
+		if !seen[r.rax] {
+			seen[r.rax] = true
+			nums = append(nums, r.rax)
 		}
 	}
-	return true
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	parts := make([]string, len(nums))
+	for i, n := range nums {
+		parts[i] = fmt.Sprint(n)
+	}
+	return strings.Join(parts, ",")
 }
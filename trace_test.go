@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	syscall "golang.org/x/sys/unix"
+	"testing"
+)
+
+/*
+ * Checks which traces share a fingerprint: only traces with the same
+ * regSets in the same order may, while a change to any recorded field,
+ * including the class of a single argument, must give a new one.
+ */
+func TestFingerprint(t *testing.T) {
+	read := regSet{rax: syscall.SYS_READ, fd: fdStdin, size: classSmall}
+	readExit := regSet{rax: syscall.SYS_READ, exit: true, ret: classSmall}
+	write := regSet{rax: syscall.SYS_WRITE, fd: fdStdout, size: classSmall}
+
+	with := func(r regSet, change func(*regSet)) regSet {
+		change(&r)
+		return r
+	}
+	tests := []struct {
+		name    string
+		a, b    []regSet
+		collide bool
+	}{
+		{"empty", nil, nil, true},
+		{"equal", []regSet{read, readExit, write}, []regSet{read, readExit, write}, true},
+		{"syscall", []regSet{read}, []regSet{with(read, func(r *regSet) { r.rax = syscall.SYS_PREAD64 })}, false},
+		{"task", []regSet{read}, []regSet{with(read, func(r *regSet) { r.task = 1 })}, false},
+		{"exit", []regSet{read}, []regSet{with(read, func(r *regSet) { r.exit = true })}, false},
+		{"fd class", []regSet{read}, []regSet{with(read, func(r *regSet) { r.fd = fdOther })}, false},
+		{"size class", []regSet{read}, []regSet{with(read, func(r *regSet) { r.size = classLarge })}, false},
+		{"return class", []regSet{readExit}, []regSet{with(readExit, func(r *regSet) { r.ret = classError })}, false},
+		{"order", []regSet{read, write}, []regSet{write, read}, false},
+		{"length", []regSet{read}, []regSet{read, read}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := fingerprint(execTrace{trace: tt.a})
+			b := fingerprint(execTrace{trace: tt.b})
+			if (a == b) != tt.collide {
+				t.Errorf("fingerprints equal: %v, want %v", a == b, tt.collide)
+			}
+		})
+	}
+}
+
+/*
+ * Checks that arguments are bucketed into their classes, so runs which
+ * only differ within a class share a fingerprint.
+ */
+func TestFingerprintClasses(t *testing.T) {
+	readRegs := func(fd, size uint64) syscall.PtraceRegs {
+		return syscall.PtraceRegs{Orig_rax: syscall.SYS_READ, Rdi: fd, Rdx: size}
+	}
+	tests := []struct {
+		name    string
+		a, b    syscall.PtraceRegs
+		collide bool
+	}{
+		{"same small size", readRegs(0, 10), readRegs(0, 20), true},
+		{"small and large size", readRegs(0, 10), readRegs(0, smallValueLimit+1), false},
+		{"other fds", readRegs(3, 10), readRegs(7, 10), true},
+		{"stdin and other fd", readRegs(0, 10), readRegs(3, 10), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := fingerprint(execTrace{trace: []regSet{getInterestingRegs(&tt.a, 0, false)}})
+			b := fingerprint(execTrace{trace: []regSet{getInterestingRegs(&tt.b, 0, false)}})
+			if (a == b) != tt.collide {
+				t.Errorf("fingerprints equal: %v, want %v", a == b, tt.collide)
+			}
+		})
+	}
+}
+
+/*
+ * Measures looking up a trace in sets of growing size. Lookups should
+ * not slow down with the number of traces seen, beyond cache misses
+ * once the set outgrows the CPU caches.
+ */
+func BenchmarkTraceSet(b *testing.B) {
+	for _, n := range []int{1e2, 1e3, 1e4, 1e5} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s := newTraceSet()
+			fingerprints := make([]traceFingerprint, n)
+			for i := range fingerprints {
+				r := regSet{rax: uint64(i)}
+				fingerprints[i] = fingerprint(execTrace{trace: []regSet{r}})
+				s.add(fingerprints[i])
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if s.add(fingerprints[i%n]) {
+					b.Fatal("trace seen before was added again")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/arch/x86/x86asm"
+	syscall "golang.org/x/sys/unix"
+	"strings"
+)
+
+/*
+ * This file contains the exploitability triage of crashes, which ranks
+ * them in the manner of !exploitable from the faulting instruction and
+ * the machine state at the crash.
+ */
+
+/*
+ * Exploitability ranks, from most to least severe.
+ */
+const (
+	rankExploitable         = "EXPLOITABLE"
+	rankProbablyExploitable = "PROBABLY_EXPLOITABLE"
+	rankUnknown             = "UNKNOWN"
+	rankProbablyNot         = "PROBABLY_NOT_EXPLOITABLE"
+)
+
+/*
+ * Faults on addresses below this are treated as null dereferences.
+ */
+const nearNullLimit = 0x10000
+
+/*
+ * Faults this close to the stack pointer are treated as the stack
+ * running out.
+ */
+const stackExhaustionDistance = 0x1000
+
+/*
+ * Result of triaging a crash.
+ * rank: exploitability rank of the crash.
+ * kind: kind of fault, e.g. "write fault" or "near-null read".
+ * instruction: disassembly of the faulting instruction, if readable.
+ */
+type triage struct {
+	rank        string
+	kind        string
+	instruction string
+}
+
+/*
+ * Formats the triage as a label, e.g. "EXPLOITABLE (write fault)".
+ */
+func (t triage) label() string {
+	return fmt.Sprintf("%s (%s)", t.rank, t.kind)
+}
+
+/*
+ * Instructions which only read the memory operand in their first
+ * argument, which is otherwise the destination.
+ */
+var readOnlyMemOps = map[x86asm.Op]bool{
+	x86asm.CMP: true, x86asm.TEST: true, x86asm.PUSH: true,
+	x86asm.CALL: true, x86asm.JMP: true, x86asm.BT: true,
+	x86asm.NOP: true, x86asm.PTEST: true, x86asm.PREFETCHNTA: true,
+	x86asm.PREFETCHT0: true, x86asm.PREFETCHT1: true, x86asm.PREFETCHT2: true,
+	x86asm.COMISS: true, x86asm.COMISD: true, x86asm.UCOMISS: true, x86asm.UCOMISD: true,
+}
+
+/*
+ * Triages a crash from its signal and machine state snapshot.
+ * Crashes without a snapshot are ranked from their signal alone.
+ */
+func triageCrash(c *crashInfo) triage {
+	switch c.signal {
+	case syscall.SIGABRT:
+		return triage{rank: rankProbablyNot, kind: "abort"}
+	case syscall.SIGFPE:
+		return triage{rank: rankProbablyNot, kind: "arithmetic error"}
+	case syscall.SIGXFSZ, syscall.SIGXCPU:
+		return triage{rank: rankProbablyNot, kind: "resource limit"}
+	}
+	s := c.snapshot
+	if s == nil {
+		return triage{rank: rankUnknown, kind: "no machine state"}
+	}
+
+	var t triage
+	inst, err := s.faultingInstruction()
+	if err == nil {
+		t.instruction = x86asm.IntelSyntax(inst, s.regs.Rip, nil)
+	}
+	switch c.signal {
+	case syscall.SIGILL:
+		t.rank, t.kind = rankProbablyExploitable, "illegal instruction"
+		return t
+	case syscall.SIGSEGV, syscall.SIGBUS:
+	default:
+		t.rank, t.kind = rankUnknown, crashClassName(c.signal)
+		return t
+	}
+
+	maps := s.mappings()
+	pc := s.regs.Rip
+	addr := s.sigAddr
+	fault := s.sigCode > 0
+
+	// Faults fetching the instruction itself.
+	if fault && addr == pc {
+		m, mapped := findMapping(maps, pc)
+		switch {
+		case pc < nearNullLimit:
+			t.rank, t.kind = rankProbablyNot, "near-null exec"
+		case mapped && !strings.Contains(m.perms, "x"):
+			t.rank, t.kind = rankExploitable, "exec fault"
+		default:
+			t.rank, t.kind = rankExploitable, "controlled PC"
+		}
+		return t
+	}
+	if err != nil {
+		t.rank, t.kind = rankUnknown, "unreadable instruction"
+		return t
+	}
+
+	// Returning or branching to a non-canonical address raises a
+	// general protection fault without a fault address.
+	if !fault && inst.Op == x86asm.RET && len(s.stack) >= stackDumpBelow+8 {
+		ret := binary.LittleEndian.Uint64(s.stack[stackDumpBelow:])
+		if !isCanonical(ret) {
+			t.rank, t.kind = rankExploitable, "controlled PC"
+			return t
+		}
+	}
+
+	write := writesMemory(inst)
+	access := "read"
+	if write {
+		access = "write"
+	}
+	switch {
+	case fault && addr < nearNullLimit:
+		t.rank, t.kind = rankProbablyNot, "near-null "+access
+	case fault && distance(addr, s.regs.Rsp) < stackExhaustionDistance &&
+		(write || inst.Op == x86asm.CALL):
+		t.rank, t.kind = rankProbablyNot, "stack exhaustion"
+	case write:
+		t.rank, t.kind = rankExploitable, "write fault"
+	case inst.Op == x86asm.CALL || inst.Op == x86asm.JMP:
+		t.rank, t.kind = rankProbablyExploitable, "read fault on branch target"
+	default:
+		t.rank, t.kind = rankUnknown, "read fault"
+	}
+	return t
+}
+
+/*
+ * Decodes the instruction at the instruction pointer of the snapshot.
+ */
+func (s *crashSnapshot) faultingInstruction() (x86asm.Inst, error) {
+	off := s.regs.Rip - s.codeAddr
+	if s.regs.Rip < s.codeAddr || off >= uint64(len(s.code)) {
+		return x86asm.Inst{}, fmt.Errorf("code at 0x%x is unreadable", s.regs.Rip)
+	}
+	return x86asm.Decode(s.code[off:], 64)
+}
+
+/*
+ * Parses the memory layout of the snapshot, skipping malformed lines.
+ */
+func (s *crashSnapshot) mappings() []memMapping {
+	var maps []memMapping
+	for _, line := range strings.Split(s.maps, "\n") {
+		m, err := parseMapping(line)
+		if err == nil {
+			maps = append(maps, m)
+		}
+	}
+	return maps
+}
+
+/*
+ * Checks whether inst writes to memory, either through a memory
+ * destination or by pushing onto the stack.
+ */
+func writesMemory(inst x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.PUSH, x86asm.CALL, x86asm.STOSB, x86asm.STOSW, x86asm.STOSD,
+		x86asm.STOSQ, x86asm.MOVSB, x86asm.MOVSW, x86asm.MOVSD, x86asm.MOVSQ:
+		return true
+	}
+	if _, ok := inst.Args[0].(x86asm.Mem); ok {
+		return !readOnlyMemOps[inst.Op]
+	}
+	return false
+}
+
+/*
+ * Checks whether addr is a canonical x86-64 address.
+ */
+func isCanonical(addr uint64) bool {
+	return addr < 0x0000800000000000 || addr >= 0xffff800000000000
+}
+
+/*
+ * Returns the distance between two addresses.
+ */
+func distance(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+/*
+ * Triages an error found by a sanitizer from its bug type and access.
+ */
+func sanitizerTriage(r sanitizerReport) triage {
+	switch {
+	case r.bugType == "SEGV":
+		return sanitizerSegvTriage(r)
+	case r.bugType == "stack-overflow":
+		return triage{rank: rankUnknown, kind: r.bugType}
+	case strings.Contains(r.bugType, "use-after-free") ||
+		strings.Contains(r.bugType, "double-free") ||
+		strings.Contains(r.bugType, "invalid-free") || r.access == "WRITE":
+		return triage{rank: rankExploitable, kind: r.bugType}
+	case r.access == "READ":
+		return triage{rank: rankProbablyExploitable, kind: r.bugType}
+	}
+	return triage{rank: rankUnknown, kind: r.bugType}
+}
+
+/*
+ * Triages a SEGV found by a sanitizer like a fault triaged from the
+ * machine state, from the address and the kind of access.
+ */
+func sanitizerSegvTriage(r sanitizerReport) triage {
+	access := strings.ToLower(r.access)
+	if access == "" {
+		access = "access"
+	}
+	switch {
+	case r.nearNull:
+		return triage{rank: rankProbablyNot, kind: "near-null " + access}
+	case r.access == "WRITE":
+		return triage{rank: rankExploitable, kind: "write fault"}
+	}
+	return triage{rank: rankUnknown, kind: access + " fault"}
+}